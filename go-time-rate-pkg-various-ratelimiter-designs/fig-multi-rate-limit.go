@@ -119,6 +119,7 @@ func (l *multiLimiter) Limit() rate.Limit {
 // that minute is **a sliding window** of time.
 // By the time we reach the eleventh request,
 // our per-minute rate limiter has accrued another token.
+// (scenario/scenario_test.go replays this timeline under a simulated clock.)
 //
 // NOTE3: Multi-dimensional rate-limiting:
 // This technique also allows us to begin thinking across dimensions
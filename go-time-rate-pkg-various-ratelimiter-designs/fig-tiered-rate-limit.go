@@ -55,6 +55,45 @@ func Per(eventCount int, duration time.Duration) rate.Limit {
 	return rate.Every(duration / time.Duration(eventCount))
 }
 
+func Open() *APIConnection {
+	return &APIConnection{
+		apiLimit: MultiLimiter( // API limiter: requests per second and requests per minute.
+			rate.NewLimiter(Per(2, time.Second), 2),
+			rate.NewLimiter(Per(10, time.Minute), 10),
+		),
+		diskLimit: MultiLimiter( // disk limiter: one read per second.
+			rate.NewLimiter(rate.Limit(1), 1),
+		),
+		networkLimit: MultiLimiter( // network limiter: three requests per second.
+			rate.NewLimiter(Per(3, time.Second), 3),
+		),
+	}
+}
+
+type APIConnection struct {
+	networkLimit,
+	diskLimit,
+	apiLimit RateLimiter
+}
+
+func (a *APIConnection) ReadFile(ctx context.Context) error {
+	err := MultiLimiter(a.apiLimit, a.diskLimit).Wait(ctx) // API tier + disk tier.
+	if err != nil {
+		return err
+	}
+	// Pretend we do work here
+	return nil
+}
+
+func (a *APIConnection) ResolveAddress(ctx context.Context) error {
+	err := MultiLimiter(a.apiLimit, a.networkLimit).Wait(ctx) // API tier + network tier.
+	if err != nil {
+		return err
+	}
+	// Pretend we do work here
+	return nil
+}
+
 type RateLimiter interface { // <1>  api limiter
 	Wait(context.Context) error
 	Limit() rate.Limit
@@ -0,0 +1,201 @@
+// Package scenario replays a workload against rate limiters under a simulated clock.
+//
+// The fig-*.go demos print their timelines with log.Printf and the results are pasted
+// into their comments. Run produces the same timeline without sleeping: every call is
+// an event on a virtual clock, and waiting on a limiter just moves the event forward
+// by the delay the limiter hands out. A run that takes a minute of wall time in the
+// demos takes microseconds here, so the timelines can be checked by tests.
+package scenario
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limiter is what the runner needs from a rate limiter: the same Limit the demos use to
+// sort their multiLimiter, and a way to reserve a token at a given (virtual) time.
+type Limiter interface {
+	Limit() rate.Limit
+	// ReserveAt takes one token at now and reports how long the caller has to wait
+	// before it may proceed.
+	ReserveAt(now time.Time) (time.Duration, error)
+}
+
+// Rate adapts a token bucket from golang.org/x/time/rate.
+func Rate(l *rate.Limiter) Limiter {
+	return rateLimiter{l}
+}
+
+type rateLimiter struct {
+	*rate.Limiter
+}
+
+func (l rateLimiter) ReserveAt(now time.Time) (time.Duration, error) {
+	r := l.ReserveN(now, 1)
+	if !r.OK() {
+		return 0, fmt.Errorf("rate: Wait(n=1) exceeds limiter's burst %d", l.Burst())
+	}
+	return r.DelayFrom(now), nil
+}
+
+// Chain is a set of limiters that are waited on one after the other,
+// like the multiLimiter of fig-multi-rate-limit.go.
+type Chain []Limiter
+
+// Multi mirrors MultiLimiter from the demos: the limiters are sorted by Limit,
+// most restrictive first. Nested chains are flattened in wait order.
+func Multi(limiters ...Limiter) Chain {
+	sorted := append(make([]Limiter, 0, len(limiters)), limiters...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Limit() < sorted[j].Limit()
+	})
+
+	var c Chain
+	for _, l := range sorted {
+		c = append(c, stages(l)...)
+	}
+	return c
+}
+
+// Limit returns the most restrictive limit of the chain.
+func (c Chain) Limit() rate.Limit {
+	if len(c) == 0 {
+		return rate.Inf
+	}
+	return c[0].Limit()
+}
+
+// ReserveAt reserves on every limiter back to back, starting the next one
+// when the previous delay has elapsed. Run does better: it interleaves the
+// stages of concurrent calls, the way concurrent Waits would.
+func (c Chain) ReserveAt(now time.Time) (time.Duration, error) {
+	var total time.Duration
+	for _, l := range c {
+		d, err := l.ReserveAt(now.Add(total))
+		if err != nil {
+			return total, err
+		}
+		total += d
+	}
+	return total, nil
+}
+
+// stages returns the limiters a call has to get through, in order.
+func stages(l Limiter) []Limiter {
+	switch l := l.(type) {
+	case nil:
+		return nil
+	case Chain:
+		return l
+	default:
+		return []Limiter{l}
+	}
+}
+
+// Call is one request of a workload.
+type Call struct {
+	Name string
+	// At is when the call is issued, relative to the start of the run.
+	At time.Duration
+	// Limiter gates the call. A nil Limiter means no rate limiting at all.
+	Limiter Limiter
+}
+
+// Event records a call going through (or failing) on the virtual clock.
+type Event struct {
+	At   time.Duration // relative to the start of the run
+	Call int           // index of the call in the workload
+	Name string
+	Err  error
+}
+
+// Timeline is the list of events of a run, in the order they happened.
+// Calls completing at the same instant are listed in workload order.
+type Timeline []Event
+
+// String renders the timeline the way the demos log it, with millisecond
+// precision, and closes it with the demos' final "Done." line.
+func (t Timeline) String() string {
+	var b strings.Builder
+	var end time.Duration
+	for _, e := range t {
+		if e.Err != nil {
+			fmt.Fprintf(&b, "%s cannot %s: %v\n", clock(e.At), e.Name, e.Err)
+		}
+		fmt.Fprintf(&b, "%s %s\n", clock(e.At), e.Name)
+		end = e.At
+	}
+	fmt.Fprintf(&b, "%s Done.\n", clock(end))
+	return b.String()
+}
+
+func clock(d time.Duration) string {
+	return time.Time{}.Add(d).Format("15:04:05.000")
+}
+
+// epoch is the virtual wall time at which every run starts.
+var epoch = time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Run plays the calls against their limiters and returns the resulting timeline.
+// No goroutine sleeps: the clock jumps from one event to the next.
+func Run(calls []Call) Timeline {
+	var q queue
+	for i, c := range calls {
+		heap.Push(&q, &pending{at: c.At, call: i, stages: stages(c.Limiter)})
+	}
+
+	var t Timeline
+	for q.Len() > 0 {
+		p := heap.Pop(&q).(*pending)
+		if p.next == len(p.stages) {
+			t = append(t, Event{At: p.at, Call: p.call, Name: calls[p.call].Name})
+			continue
+		}
+
+		d, err := p.stages[p.next].ReserveAt(epoch.Add(p.at))
+		if err != nil {
+			t = append(t, Event{At: p.at, Call: p.call, Name: calls[p.call].Name, Err: err})
+			continue
+		}
+		p.at += d
+		p.next++
+		heap.Push(&q, p)
+	}
+	return t
+}
+
+// pending is a call waiting for its next stage at time at.
+type pending struct {
+	at     time.Duration
+	call   int
+	stages []Limiter
+	next   int
+}
+
+// queue orders pending calls by time, then by their position in the workload.
+type queue []*pending
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].call < q[j].call
+}
+
+func (q queue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *queue) Push(x interface{}) { *q = append(*q, x.(*pending)) }
+
+func (q *queue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,167 @@
+package scenario
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func per(eventCount int, duration time.Duration) rate.Limit {
+	return rate.Every(duration / time.Duration(eventCount))
+}
+
+// demoWorkload is the driver of the fig-*.go demos: 10 ReadFile calls and
+// 10 ResolveAddress calls, all issued at once.
+func demoWorkload(readFile, resolveAddress Limiter) []Call {
+	var calls []Call
+	for i := 0; i < 10; i++ {
+		calls = append(calls, Call{Name: "ReadFile", Limiter: readFile})
+	}
+	for i := 0; i < 10; i++ {
+		calls = append(calls, Call{Name: "ResolveAddress", Limiter: resolveAddress})
+	}
+	return calls
+}
+
+// demos rebuild the Open() of each fig-*.go program.
+var demos = []struct {
+	name  string
+	calls func() []Call
+}{
+	{
+		name: "fig-no-rate-limit",
+		calls: func() []Call {
+			return demoWorkload(nil, nil)
+		},
+	},
+	{
+		name: "fig-simple-rate-limit",
+		calls: func() []Call {
+			rateLimiter := Rate(rate.NewLimiter(rate.Limit(1), 1))
+			return demoWorkload(rateLimiter, rateLimiter)
+		},
+	},
+	{
+		name: "fig-multi-rate-limit",
+		calls: func() []Call {
+			secondLimit := Rate(rate.NewLimiter(per(2, time.Second), 1))
+			minuteLimit := Rate(rate.NewLimiter(per(10, time.Minute), 10))
+			rateLimiter := Multi(secondLimit, minuteLimit)
+			return demoWorkload(rateLimiter, rateLimiter)
+		},
+	},
+	{
+		name: "fig-combined-rate-limit",
+		calls: func() []Call {
+			apiLimit := Multi(
+				Rate(rate.NewLimiter(per(2, time.Second), 2)),
+				Rate(rate.NewLimiter(per(10, time.Minute), 10)),
+			)
+			diskLimit := Multi(Rate(rate.NewLimiter(rate.Limit(1), 1)))
+			networkLimit := Multi(Rate(rate.NewLimiter(per(3, time.Second), 3)))
+			return demoWorkload(Multi(apiLimit, diskLimit), Multi(apiLimit, networkLimit))
+		},
+	},
+	{
+		name: "fig-tiered-rate-limit",
+		calls: func() []Call {
+			apiLimit := Multi(
+				Rate(rate.NewLimiter(per(2, time.Second), 2)),
+				Rate(rate.NewLimiter(per(10, time.Minute), 10)),
+			)
+			diskLimit := Multi(Rate(rate.NewLimiter(rate.Limit(1), 1)))
+			networkLimit := Multi(Rate(rate.NewLimiter(per(3, time.Second), 3)))
+			return demoWorkload(Multi(apiLimit, diskLimit), Multi(apiLimit, networkLimit))
+		},
+	},
+}
+
+func TestDemoTimelines(t *testing.T) {
+	for _, demo := range demos {
+		demo := demo
+		t.Run(demo.name, func(t *testing.T) {
+			got := Run(demo.calls()).String()
+
+			golden := filepath.Join("testdata", demo.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("timeline does not match %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// TestMultiRateLimitEleventhCall checks NOTE2 of fig-multi-rate-limit.go:
+// the eleventh call does not wait a full six seconds after the tenth one,
+// because the per-minute bucket has been refilling since the start.
+func TestMultiRateLimitEleventhCall(t *testing.T) {
+	timeline := Run(demos[2].calls())
+
+	tenth, eleventh := timeline[9].At, timeline[10].At
+	if eleventh != 6*time.Second {
+		t.Errorf("expected call #11 at 6s; got %v", eleventh)
+	}
+	if gap := eleventh - tenth; gap >= 6*time.Second {
+		t.Errorf("expected call #11 less than 6s after call #10; got %v", gap)
+	}
+	for i := 11; i < len(timeline); i++ {
+		if gap := timeline[i].At - timeline[i-1].At; gap != 6*time.Second {
+			t.Errorf("expected 6s between calls #%d and #%d; got %v", i, i+1, gap)
+		}
+	}
+}
+
+// TestRunInterleavesStages checks that a call waiting on the first limiter of a chain
+// does not hold up the calls behind it on the second one.
+func TestRunInterleavesStages(t *testing.T) {
+	slow := Rate(rate.NewLimiter(rate.Every(time.Second), 1))
+	shared := Rate(rate.NewLimiter(rate.Every(time.Second), 1))
+
+	timeline := Run([]Call{
+		{Name: "a", Limiter: Chain{slow, shared}},
+		{Name: "b", Limiter: Chain{slow, shared}},
+		{Name: "c", At: 500 * time.Millisecond, Limiter: shared},
+	})
+
+	want := []struct {
+		name string
+		at   time.Duration
+	}{
+		{"a", 0},
+		{"c", time.Second},
+		{"b", 2 * time.Second},
+	}
+	if len(timeline) != len(want) {
+		t.Fatalf("expected %d events; got %d", len(want), len(timeline))
+	}
+	for i, w := range want {
+		if timeline[i].Name != w.name || timeline[i].At != w.at {
+			t.Errorf("event %d: expected %s at %v; got %s at %v", i, w.name, w.at, timeline[i].Name, timeline[i].At)
+		}
+	}
+}
+
+func TestRunReportsErrors(t *testing.T) {
+	timeline := Run([]Call{
+		{Name: "ReadFile", Limiter: Rate(rate.NewLimiter(rate.Limit(1), 0))},
+	})
+
+	if len(timeline) != 1 || timeline[0].Err == nil {
+		t.Fatalf("expected one failed event; got %v", timeline)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/ntrajic/rate-limiters/kong-ratelimiter
+
+go 1.18
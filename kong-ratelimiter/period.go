@@ -0,0 +1,57 @@
+package ratelimiting
+
+import "time"
+
+// Period is one of the windows Kong counts requests in.
+type Period int
+
+const (
+	Second Period = iota
+	Minute
+	Hour
+	Day
+	Month
+	Year
+)
+
+// periods are all the Periods, from the shortest, as ORDERED_PERIODS in schema.lua.
+var periods = []Period{Second, Minute, Hour, Day, Month, Year}
+
+var periodNames = [...]string{"second", "minute", "hour", "day", "month", "year"}
+
+// headerNames are the suffixes of the X-RateLimit-* headers of each Period.
+var headerNames = [...]string{"Second", "Minute", "Hour", "Day", "Month", "Year"}
+
+// expirations are the lengths of the Periods in seconds, as in expiration.lua:
+// a month is 30 days and a year 365, whatever the calendar says.
+var expirations = [...]int64{1, 60, 3600, 86400, 2592000, 31536000}
+
+func (p Period) String() string {
+	return periodNames[p]
+}
+
+// expiration is how long the counter of a window of p is kept.
+func (p Period) expiration() time.Duration {
+	return time.Duration(expirations[p]) * time.Second
+}
+
+// start returns when the window of p that holds t started, in UTC,
+// as kong.tools.timestamp.get_timestamps does: windows are calendar
+// windows, not sliding ones, so a month starts on the 1st.
+func (p Period) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case Second:
+		return t.Truncate(time.Second)
+	case Minute:
+		return t.Truncate(time.Minute)
+	case Hour:
+		return t.Truncate(time.Hour)
+	case Day:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case Month:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
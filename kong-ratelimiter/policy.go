@@ -0,0 +1,108 @@
+package ratelimiting
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// emptyUUID stands for a missing service or route in the keys of the counters.
+const emptyUUID = "00000000-0000-0000-0000-000000000000"
+
+// Policy keeps the counters of the requests, as the policies of policies/init.lua do.
+type Policy interface {
+	// Usage returns the number of requests of identifier in the window of period that holds now.
+	Usage(ctx context.Context, conf *Config, identifier string, period Period, now time.Time) (int64, error)
+	// Increment adds value to the counters of identifier in the windows that hold now,
+	// for the periods that have a limit.
+	Increment(ctx context.Context, conf *Config, limits map[Period]int64, identifier string, now time.Time, value int64) error
+}
+
+// counterKey is the key of a counter, as get_local_key makes it:
+// ratelimit:<route>:<service>:<identifier>:<window start in ms>:<period>.
+func counterKey(conf *Config, identifier string, period Period, now time.Time) string {
+	serviceID, routeID := conf.ServiceID, conf.RouteID
+	if serviceID == "" {
+		serviceID = emptyUUID
+	}
+	if routeID == "" {
+		routeID = emptyUUID
+	}
+	return fmt.Sprintf("ratelimit:%s:%s:%s:%d:%s", routeID, serviceID, identifier,
+		period.start(now).UnixNano()/int64(time.Millisecond), period)
+}
+
+// localCounter is a counter of the LocalPolicy.
+type localCounter struct {
+	value   int64
+	expires time.Time
+}
+
+// LocalPolicy keeps the counters in the memory of the process, like the "local" policy keeps them
+// in the shared memory of a Kong node: the replicas of a service each count their own requests.
+// It is the default Policy.
+type LocalPolicy struct {
+	mu       sync.Mutex
+	counters map[string]*localCounter
+	// sweepAt is the number of counters at which the expired ones are dropped.
+	sweepAt int
+}
+
+// minSweep is the number of counters below which LocalPolicy doesn't bother dropping the expired ones.
+const minSweep = 1024
+
+// NewLocalPolicy returns an empty LocalPolicy.
+func NewLocalPolicy() *LocalPolicy {
+	return &LocalPolicy{counters: make(map[string]*localCounter), sweepAt: minSweep}
+}
+
+// Usage implements Policy.
+func (p *LocalPolicy) Usage(ctx context.Context, conf *Config, identifier string, period Period, now time.Time) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := p.counters[counterKey(conf, identifier, period, now)]
+	if c == nil || !now.Before(c.expires) {
+		return 0, nil
+	}
+	return c.value, nil
+}
+
+// Increment implements Policy. As shm:incr does, a counter expires a period after it is created,
+// not after it is last incremented.
+func (p *LocalPolicy) Increment(ctx context.Context, conf *Config, limits map[Period]int64, identifier string, now time.Time, value int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.counters) >= p.sweepAt {
+		p.sweep(now)
+	}
+
+	for _, period := range periods {
+		if _, ok := limits[period]; !ok {
+			continue
+		}
+		key := counterKey(conf, identifier, period, now)
+		c := p.counters[key]
+		if c == nil || !now.Before(c.expires) {
+			c = &localCounter{expires: now.Add(period.expiration())}
+			p.counters[key] = c
+		}
+		c.value += value
+	}
+	return nil
+}
+
+// sweep drops the expired counters.
+func (p *LocalPolicy) sweep(now time.Time) {
+	for key, c := range p.counters {
+		if !now.Before(c.expires) {
+			delete(p.counters, key)
+		}
+	}
+	p.sweepAt = 2 * len(p.counters)
+	if p.sweepAt < minSweep {
+		p.sweepAt = minSweep
+	}
+}
@@ -0,0 +1,356 @@
+// Package ratelimiting is a net/http port of the rate-limiting plugin of Kong (handler.lua, version 2.3.0):
+// it counts the requests of each client in calendar windows of a second up to a year,
+// and rejects them with a 429 once one of the configured limits is reached.
+package ratelimiting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// LimitBy selects what the requests are counted by, as limit_by does.
+// Whatever it is, a request that lacks it is counted by its client IP.
+type LimitBy string
+
+const (
+	// LimitByConsumer counts by the consumer of ContextWithConsumer, or else the credential. It is the default.
+	LimitByConsumer LimitBy = "consumer"
+	// LimitByCredential counts by the credential of ContextWithCredential.
+	LimitByCredential LimitBy = "credential"
+	// LimitByIP counts by client IP.
+	LimitByIP LimitBy = "ip"
+	// LimitByService counts by the service of ContextWithService.
+	LimitByService LimitBy = "service"
+	// LimitByHeader counts by the value of the HeaderName header.
+	LimitByHeader LimitBy = "header"
+	// LimitByPath counts the requests for Path together.
+	LimitByPath LimitBy = "path"
+)
+
+// Config is the configuration of the plugin, as in schema.lua, but for the Redis and cluster policies.
+// A limit of 0 is no limit; at least one must be set, and a longer period may not have a lower limit.
+type Config struct {
+	Second int64
+	Minute int64
+	Hour   int64
+	Day    int64
+	Month  int64
+	Year   int64
+
+	LimitBy    LimitBy
+	HeaderName string // for LimitByHeader.
+	Path       string // for LimitByPath.
+
+	// ServiceID and RouteID, if set, keep the counters of the middleware apart
+	// from those of others that share its Policy.
+	ServiceID string
+	RouteID   string
+
+	// FaultTolerant lets the requests through when the Policy fails, instead of answering with a 500.
+	// Unlike in Kong, it is false by default.
+	FaultTolerant bool
+	// HideClientHeaders stops the middleware from sending the X-RateLimit-* and RateLimit-* headers.
+	HideClientHeaders bool
+}
+
+// limits returns the limits of c, by period.
+func (c *Config) limits() map[Period]int64 {
+	limits := make(map[Period]int64)
+	for i, limit := range []int64{c.Second, c.Minute, c.Hour, c.Day, c.Month, c.Year} {
+		if limit != 0 {
+			limits[periods[i]] = limit
+		}
+	}
+	return limits
+}
+
+// validate checks c as schema.lua does, and sets the default LimitBy.
+func (c *Config) validate() error {
+	limits := c.limits()
+	if len(limits) == 0 {
+		return errors.New("at least one of second, minute, hour, day, month or year must be set")
+	}
+
+	for _, period := range periods {
+		if limits[period] < 0 {
+			return fmt.Errorf("negative limit for %s: %d", period, limits[period])
+		}
+	}
+
+	// validate_periods_order
+	for i, lower := range periods {
+		v1, ok := limits[lower]
+		if !ok {
+			continue
+		}
+		for _, upper := range periods[i+1:] {
+			if v2, ok := limits[upper]; ok && v2 < v1 {
+				return fmt.Errorf("the limit for %s(%.1f) cannot be lower than the limit for %s(%.1f)",
+					upper, float64(v2), lower, float64(v1))
+			}
+		}
+	}
+
+	switch c.LimitBy {
+	case "":
+		c.LimitBy = LimitByConsumer
+	case LimitByConsumer, LimitByCredential, LimitByIP, LimitByService:
+	case LimitByHeader:
+		if c.HeaderName == "" {
+			return errors.New("header name is required when limiting by header")
+		}
+	case LimitByPath:
+		if c.Path == "" {
+			return errors.New("path is required when limiting by path")
+		}
+	default:
+		return fmt.Errorf("unknown limit_by: %q", c.LimitBy)
+	}
+	return nil
+}
+
+type contextKey int
+
+const (
+	consumerKey contextKey = iota
+	credentialKey
+	serviceKey
+)
+
+// ContextWithConsumer returns a copy of ctx with the id of the consumer a request authenticated as,
+// what kong.client.get_consumer returns, for LimitByConsumer.
+func ContextWithConsumer(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, consumerKey, id)
+}
+
+// ContextWithCredential returns a copy of ctx with the id of the credential a request authenticated with,
+// what kong.client.get_credential returns, for LimitByCredential and LimitByConsumer.
+func ContextWithCredential(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, credentialKey, id)
+}
+
+// ContextWithService returns a copy of ctx with the id of the service a request is routed to,
+// what kong.router.get_service returns, for LimitByService.
+func ContextWithService(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, serviceKey, id)
+}
+
+func fromContext(ctx context.Context, key contextKey) string {
+	id, _ := ctx.Value(key).(string)
+	return id
+}
+
+// Option configures what Config does not cover.
+type Option func(*rateLimiting)
+
+// WithPolicy keeps the counters in policy instead of a LocalPolicy of the middleware,
+// e.g. to share it between middlewares, or with another process.
+func WithPolicy(policy Policy) Option {
+	return func(rl *rateLimiting) {
+		rl.policy = policy
+	}
+}
+
+// WithClientIP replaces the address of the peer of a request as its client IP,
+// e.g. with the one a trusted proxy reports, as kong.client.get_forwarded_ip does.
+func WithClientIP(clientIP func(r *http.Request) string) Option {
+	return func(rl *rateLimiting) {
+		rl.clientIP = clientIP
+	}
+}
+
+// withClock replaces time.Now, for tests.
+func withClock(now func() time.Time) Option {
+	return func(rl *rateLimiting) {
+		rl.now = now
+	}
+}
+
+type rateLimiting struct {
+	conf     Config
+	limits   map[Period]int64
+	policy   Policy
+	clientIP func(r *http.Request) string
+	now      func() time.Time
+	next     http.Handler
+}
+
+// New returns the middleware of conf in front of next.
+func New(next http.Handler, conf Config, opts ...Option) (http.Handler, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	rl := &rateLimiting{
+		conf:     conf,
+		limits:   conf.limits(),
+		clientIP: peerIP,
+		now:      time.Now,
+		next:     next,
+	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+	if rl.policy == nil {
+		rl.policy = NewLocalPolicy()
+	}
+	return rl, nil
+}
+
+// peerIP is the address of the peer of r, without its port.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// identifier returns what r is counted by, as get_identifier does.
+func (rl *rateLimiting) identifier(r *http.Request) string {
+	var id string
+	switch rl.conf.LimitBy {
+	case LimitByService:
+		id = fromContext(r.Context(), serviceKey)
+	case LimitByConsumer:
+		id = fromContext(r.Context(), consumerKey)
+		if id == "" {
+			id = fromContext(r.Context(), credentialKey)
+		}
+	case LimitByCredential:
+		id = fromContext(r.Context(), credentialKey)
+	case LimitByHeader:
+		id = r.Header.Get(rl.conf.HeaderName)
+	case LimitByPath:
+		if r.URL.Path == rl.conf.Path {
+			id = r.URL.Path
+		}
+	}
+
+	if id == "" {
+		return rl.clientIP(r)
+	}
+	return id
+}
+
+// usage is the state of the counter of a period.
+type usage struct {
+	limit     int64
+	remaining int64
+}
+
+// usage returns the usage of identifier in each of the windows that hold now,
+// and the period whose limit is reached, if any, as get_usage does.
+func (rl *rateLimiting) usage(ctx context.Context, identifier string, now time.Time) (map[Period]usage, Period, bool, error) {
+	usages := make(map[Period]usage)
+	var stop Period
+	var stopped bool
+
+	for _, period := range periods {
+		limit, ok := rl.limits[period]
+		if !ok {
+			continue
+		}
+		current, err := rl.policy.Usage(ctx, &rl.conf, identifier, period, now)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		remaining := limit - current
+		usages[period] = usage{limit: limit, remaining: remaining}
+		if remaining <= 0 {
+			stop, stopped = period, true
+		}
+	}
+	return usages, stop, stopped, nil
+}
+
+func (rl *rateLimiting) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Kong counts in whole seconds.
+	now := rl.now().Truncate(time.Second)
+	identifier := rl.identifier(r)
+
+	usages, stop, stopped, err := rl.usage(r.Context(), identifier, now)
+	if err != nil {
+		log.Printf("rate-limiting: failed to get usage: %v", err)
+		if !rl.conf.FaultTolerant {
+			http.Error(w, "An unexpected error occurred", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if usages != nil {
+		var reset int64
+		if !rl.conf.HideClientHeaders {
+			reset = rl.setHeaders(w.Header(), usages, stop, stopped, now)
+		}
+
+		// If limit is exceeded, terminate the request.
+		if stopped {
+			// As in Kong, there is no Retry-After when the headers are hidden.
+			if reset > 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(reset, 10))
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"message":"API rate limit exceeded"}`))
+			return
+		}
+	}
+
+	if err := rl.policy.Increment(r.Context(), &rl.conf, rl.limits, identifier, now, 1); err != nil {
+		log.Printf("rate-limiting: could not increment counters: %v", err)
+	}
+
+	rl.next.ServeHTTP(w, r)
+}
+
+// setHeaders sets the X-RateLimit-Limit-<Period> and X-RateLimit-Remaining-<Period> headers
+// of each limit, and the RateLimit-* ones of the limit closest to being reached,
+// the longest one among those as close. It returns RateLimit-Reset, in seconds.
+func (rl *rateLimiting) setHeaders(h http.Header, usages map[Period]usage, stop Period, stopped bool, now time.Time) int64 {
+	var (
+		limit, remaining, reset int64
+		window                  int64
+		chosen                  bool
+	)
+
+	for _, period := range periods {
+		u, ok := usages[period]
+		if !ok {
+			continue
+		}
+
+		// The request being let through counts too, unless another limit is reached.
+		currentRemaining := u.remaining
+		if !stopped || stop == period {
+			currentRemaining--
+		}
+		if currentRemaining < 0 {
+			currentRemaining = 0
+		}
+
+		currentWindow := expirations[period]
+		if !chosen || currentRemaining < remaining || currentRemaining == remaining && currentWindow > window {
+			chosen = true
+			limit, window, remaining = u.limit, currentWindow, currentRemaining
+			elapsed := now.Sub(period.start(now)).Milliseconds() / 1000
+			reset = int64(math.Max(1, float64(window-elapsed)))
+		}
+
+		h.Set("X-RateLimit-Limit-"+headerNames[period], strconv.FormatInt(u.limit, 10))
+		h.Set("X-RateLimit-Remaining-"+headerNames[period], strconv.FormatInt(currentRemaining, 10))
+	}
+
+	h.Set("RateLimit-Limit", strconv.FormatInt(limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	return reset
+}
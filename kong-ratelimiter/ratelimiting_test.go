@@ -0,0 +1,404 @@
+package ratelimiting
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestPeriodStart(t *testing.T) {
+	now := time.Date(2022, time.August, 25, 13, 14, 15, 500_000_000, time.FixedZone("CEST", 2*3600))
+
+	tests := []struct {
+		period Period
+		want   time.Time
+	}{
+		{period: Second, want: time.Date(2022, time.August, 25, 11, 14, 15, 0, time.UTC)},
+		{period: Minute, want: time.Date(2022, time.August, 25, 11, 14, 0, 0, time.UTC)},
+		{period: Hour, want: time.Date(2022, time.August, 25, 11, 0, 0, 0, time.UTC)},
+		{period: Day, want: time.Date(2022, time.August, 25, 0, 0, 0, 0, time.UTC)},
+		{period: Month, want: time.Date(2022, time.August, 1, 0, 0, 0, 0, time.UTC)},
+		{period: Year, want: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		if got := tt.period.start(now); !got.Equal(tt.want) {
+			t.Errorf("%s: expected %v; got %v", tt.period, tt.want, got)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		conf Config
+		want string
+	}{
+		{
+			desc: "no limit",
+			conf: Config{},
+			want: "at least one of second, minute, hour, day, month or year must be set",
+		},
+		{
+			desc: "negative limit",
+			conf: Config{Minute: -1},
+			want: "negative limit for minute: -1",
+		},
+		{
+			desc: "periods out of order",
+			conf: Config{Second: 10, Hour: 5},
+			want: "the limit for hour(5.0) cannot be lower than the limit for second(10.0)",
+		},
+		{
+			desc: "header without a name",
+			conf: Config{Minute: 1, LimitBy: LimitByHeader},
+			want: "header name is required when limiting by header",
+		},
+		{
+			desc: "path without a path",
+			conf: Config{Minute: 1, LimitBy: LimitByPath},
+			want: "path is required when limiting by path",
+		},
+		{
+			desc: "unknown limit_by",
+			conf: Config{Minute: 1, LimitBy: "cookie"},
+			want: `unknown limit_by: "cookie"`,
+		},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		if _, err := New(next, tt.conf); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: expected %q; got %v", tt.desc, tt.want, err)
+		}
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+	tests := []struct {
+		desc       string
+		conf       Config
+		path       string
+		header     string
+		consumer   string
+		credential string
+		service    string
+		want       string
+	}{
+		{desc: "consumer", conf: Config{}, consumer: "alice", credential: "key-1", want: "alice"},
+		{desc: "consumer, credential", conf: Config{}, credential: "key-1", want: "key-1"},
+		{desc: "consumer, anonymous", conf: Config{}, want: "192.0.2.1"},
+		{desc: "credential", conf: Config{LimitBy: LimitByCredential}, consumer: "alice", credential: "key-1", want: "key-1"},
+		{desc: "credential, none", conf: Config{LimitBy: LimitByCredential}, consumer: "alice", want: "192.0.2.1"},
+		{desc: "ip", conf: Config{LimitBy: LimitByIP}, consumer: "alice", want: "192.0.2.1"},
+		{desc: "service", conf: Config{LimitBy: LimitByService}, service: "billing", want: "billing"},
+		{desc: "service, none", conf: Config{LimitBy: LimitByService}, want: "192.0.2.1"},
+		{desc: "header", conf: Config{LimitBy: LimitByHeader, HeaderName: "X-Api-Key"}, header: "k1", want: "k1"},
+		{desc: "header, missing", conf: Config{LimitBy: LimitByHeader, HeaderName: "X-Api-Key"}, want: "192.0.2.1"},
+		{desc: "path", conf: Config{LimitBy: LimitByPath, Path: "/login"}, path: "/login", want: "/login"},
+		{desc: "path, other", conf: Config{LimitBy: LimitByPath, Path: "/login"}, path: "/login/sso", want: "192.0.2.1"},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		tt.conf.Minute = 1
+		h, err := New(next, tt.conf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		path := tt.path
+		if path == "" {
+			path = "/"
+		}
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Api-Key", tt.header)
+		ctx := req.Context()
+		if tt.consumer != "" {
+			ctx = ContextWithConsumer(ctx, tt.consumer)
+		}
+		if tt.credential != "" {
+			ctx = ContextWithCredential(ctx, tt.credential)
+		}
+		if tt.service != "" {
+			ctx = ContextWithService(ctx, tt.service)
+		}
+
+		if got := h.(*rateLimiting).identifier(req.WithContext(ctx)); got != tt.want {
+			t.Errorf("%s: expected %q; got %q", tt.desc, tt.want, got)
+		}
+	}
+}
+
+// step is a request, after the clock moved by advance, and what it is expected to get.
+type step struct {
+	advance time.Duration
+	addr    string // 192.0.2.1 by default.
+	status  int
+	headers map[string]string // "" for a header that must not be set.
+}
+
+func TestRateLimiting(t *testing.T) {
+	// 10:00:30 UTC, halfway through a minute.
+	start := time.Date(2022, time.August, 25, 10, 0, 30, 0, time.UTC)
+
+	tests := []struct {
+		desc  string
+		conf  Config
+		steps []step
+	}{
+		{
+			desc: "one limit",
+			conf: Config{Minute: 2},
+			steps: []step{
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Limit-Minute":     "2",
+					"X-RateLimit-Remaining-Minute": "1",
+					"RateLimit-Limit":              "2",
+					"RateLimit-Remaining":          "1",
+					"RateLimit-Reset":              "30",
+				}},
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Minute": "0",
+					"RateLimit-Remaining":          "0",
+				}},
+				{advance: 10 * time.Second, status: http.StatusTooManyRequests, headers: map[string]string{
+					"X-RateLimit-Remaining-Minute": "0",
+					"RateLimit-Reset":              "20",
+					"Retry-After":                  "20",
+				}},
+				// Another client has a counter of its own.
+				{addr: "192.0.2.2:1234", status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Minute": "1",
+				}},
+				// The counter starts over with the next minute, not a minute after the first request.
+				{advance: 20 * time.Second, status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Minute": "1",
+					"RateLimit-Reset":              "60",
+				}},
+			},
+		},
+		{
+			desc: "several limits",
+			conf: Config{Second: 2, Minute: 3, Hour: 100},
+			steps: []step{
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Limit-Second":     "2",
+					"X-RateLimit-Remaining-Second": "1",
+					"X-RateLimit-Limit-Minute":     "3",
+					"X-RateLimit-Remaining-Minute": "2",
+					"X-RateLimit-Limit-Hour":       "100",
+					"X-RateLimit-Remaining-Hour":   "99",
+					"X-RateLimit-Limit-Day":        "",
+					// The second is closest to its limit.
+					"RateLimit-Limit":     "2",
+					"RateLimit-Remaining": "1",
+					"RateLimit-Reset":     "1",
+				}},
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Second": "0",
+					"X-RateLimit-Remaining-Minute": "1",
+					"RateLimit-Limit":              "2",
+					"RateLimit-Remaining":          "0",
+					"RateLimit-Reset":              "1",
+				}},
+				// The second is over: the other limits don't count this request.
+				{status: http.StatusTooManyRequests, headers: map[string]string{
+					"X-RateLimit-Remaining-Second": "0",
+					"X-RateLimit-Remaining-Minute": "1",
+					"X-RateLimit-Remaining-Hour":   "98",
+					"Retry-After":                  "1",
+				}},
+				{advance: time.Second, status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Second": "1",
+					"X-RateLimit-Remaining-Minute": "0",
+					"RateLimit-Limit":              "3",
+					"RateLimit-Remaining":          "0",
+					"RateLimit-Reset":              "29",
+				}},
+				{advance: time.Second, status: http.StatusTooManyRequests, headers: map[string]string{
+					"X-RateLimit-Remaining-Second": "2",
+					"X-RateLimit-Remaining-Minute": "0",
+					"Retry-After":                  "28",
+				}},
+			},
+		},
+		{
+			desc: "month and year",
+			conf: Config{Month: 1, Year: 1},
+			steps: []step{
+				// The month and the year have 0 left: the year is the longer one.
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Remaining-Month": "0",
+					"X-RateLimit-Remaining-Year":  "0",
+					"RateLimit-Limit":             "1",
+					"RateLimit-Reset":             "11109570",
+				}},
+				{advance: 7 * 24 * time.Hour, status: http.StatusTooManyRequests, headers: map[string]string{
+					"Retry-After": "10504770",
+				}},
+			},
+		},
+		{
+			desc: "hidden headers",
+			conf: Config{Minute: 1, HideClientHeaders: true},
+			steps: []step{
+				{status: http.StatusOK, headers: map[string]string{
+					"X-RateLimit-Limit-Minute": "",
+					"RateLimit-Limit":          "",
+				}},
+				// Kong doesn't compute the reset either, so there is no Retry-After.
+				{status: http.StatusTooManyRequests, headers: map[string]string{
+					"X-RateLimit-Remaining-Minute": "",
+					"Retry-After":                  "",
+				}},
+			},
+		},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		clock := &fakeClock{now: start}
+		h, err := New(next, tt.conf, withClock(clock.Now))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+
+		for i, s := range tt.steps {
+			clock.now = clock.now.Add(s.advance)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			if s.addr != "" {
+				req.RemoteAddr = s.addr
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != s.status {
+				t.Errorf("%s, request %d: expected %d; got %d", tt.desc, i+1, s.status, rec.Code)
+			}
+			for header, want := range s.headers {
+				if got := rec.Header().Get(header); got != want {
+					t.Errorf("%s, request %d: %s: expected %q; got %q", tt.desc, i+1, header, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestRateLimitingBody(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := New(next, Config{Minute: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Errorf("expected a JSON body; got %q", got)
+	}
+	if got, want := rec.Body.String(), `{"message":"API rate limit exceeded"}`; got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+}
+
+// failingPolicy is a Policy whose store is down.
+type failingPolicy struct{}
+
+func (failingPolicy) Usage(context.Context, *Config, string, Period, time.Time) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func (failingPolicy) Increment(context.Context, *Config, map[Period]int64, string, time.Time, int64) error {
+	return errors.New("connection refused")
+}
+
+func TestRateLimitingFaultTolerant(t *testing.T) {
+	tests := []struct {
+		faultTolerant bool
+		want          int
+	}{
+		{faultTolerant: true, want: http.StatusOK},
+		{faultTolerant: false, want: http.StatusInternalServerError},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		h, err := New(next, Config{Second: 1, FaultTolerant: tt.faultTolerant}, WithPolicy(failingPolicy{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != tt.want {
+			t.Errorf("fault tolerant %v: expected %d; got %d", tt.faultTolerant, tt.want, rec.Code)
+		}
+		if got := rec.Header().Get("RateLimit-Limit"); got != "" {
+			t.Errorf("fault tolerant %v: expected no headers; got RateLimit-Limit %q", tt.faultTolerant, got)
+		}
+	}
+}
+
+// TestLocalPolicyScope tests whether middlewares sharing a LocalPolicy count apart
+// when their service or route differ, and together otherwise.
+func TestLocalPolicyScope(t *testing.T) {
+	policy := NewLocalPolicy()
+	clock := &fakeClock{now: time.Date(2022, time.August, 25, 10, 0, 0, 0, time.UTC)}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	newHandler := func(routeID string) http.Handler {
+		h, err := New(next, Config{Minute: 1, LimitBy: LimitByIP, RouteID: routeID}, WithPolicy(policy), withClock(clock.Now))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	serve := func(h http.Handler) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Code
+	}
+
+	a, b, b2 := newHandler("a"), newHandler("b"), newHandler("b")
+	for _, tt := range []struct {
+		desc string
+		h    http.Handler
+		want int
+	}{
+		{desc: "route a", h: a, want: http.StatusOK},
+		{desc: "route b", h: b, want: http.StatusOK},
+		{desc: "route b, again", h: b2, want: http.StatusTooManyRequests},
+		{desc: "route a, again", h: a, want: http.StatusTooManyRequests},
+	} {
+		if got := serve(tt.h); got != tt.want {
+			t.Errorf("%s: expected %d; got %d", tt.desc, tt.want, got)
+		}
+	}
+
+	// Expired counters are dropped.
+	clock.now = clock.now.Add(time.Minute)
+	policy.sweep(clock.now)
+	if n := len(policy.counters); n != 0 {
+		t.Errorf("expected no counters left; got %d", n)
+	}
+}
@@ -0,0 +1,100 @@
+// Package bulkhead caps the number of calls running at once, for the
+// throttles of simple_throttle and throttle_token_bucket. A rate alone
+// doesn't: 10 calls per second that take 30s each are 300 calls in flight.
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned when the calls in flight and the queue of a
+	// Bulkhead are both full. It means the wrapped function is slow, not
+	// that it is called too often.
+	ErrFull = errors.New("too many calls in flight")
+	// ErrTimeout is returned by a call that waited in the queue of a
+	// Bulkhead for longer than its queue timeout.
+	ErrTimeout = errors.New("timed out waiting for a call in flight to finish")
+)
+
+// Bulkhead lets maxInFlight calls run at once. Calls beyond that wait in
+// a queue of queueSize calls, for at most queueTimeout (or until their
+// context is done if queueTimeout is <= 0).
+// A Bulkhead can be shared by several throttles to cap them together.
+type Bulkhead struct {
+	slots     chan struct{} // one per call in flight
+	queueSize int
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	queued int
+}
+
+// New returns a Bulkhead that lets maxInFlight calls run at once.
+func New(maxInFlight int, queueSize int, queueTimeout time.Duration) *Bulkhead {
+	return &Bulkhead{
+		slots:     make(chan struct{}, maxInFlight),
+		queueSize: queueSize,
+		timeout:   queueTimeout,
+	}
+}
+
+// InFlight returns the number of calls running.
+func (b *Bulkhead) InFlight() int {
+	return len(b.slots)
+}
+
+// Queued returns the number of calls waiting for a call in flight to finish.
+func (b *Bulkhead) Queued() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.queued
+}
+
+// Enter waits for a slot, queueing if there is room in the queue. The
+// returned function gives the slot back once the call is done.
+func (b *Bulkhead) Enter(ctx context.Context) (func(), error) {
+	select {
+	case b.slots <- struct{}{}:
+		return b.leave, nil
+	default:
+	}
+
+	b.mu.Lock()
+	if b.queued >= b.queueSize {
+		b.mu.Unlock()
+		return nil, ErrFull
+	}
+	b.queued++
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.queued--
+		b.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if b.timeout > 0 {
+		timer := time.NewTimer(b.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case b.slots <- struct{}{}:
+		return b.leave, nil
+	case <-timeout:
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *Bulkhead) leave() {
+	<-b.slots
+}
@@ -0,0 +1,68 @@
+package bulkhead
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBulkhead tests whether calls beyond maxInFlight queue, and whether
+// the calls beyond the queue are rejected.
+func TestBulkhead(t *testing.T) {
+	b := New(1, 1, 0)
+
+	leave, err := b.Enter(context.Background())
+	if err != nil {
+		t.Fatal("expected the first call to run; got", err)
+	}
+
+	entered := make(chan error, 1)
+	go func() {
+		leave, err := b.Enter(context.Background())
+		if err == nil {
+			leave()
+		}
+		entered <- err
+	}()
+	for b.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := b.Enter(context.Background()); !errors.Is(err, ErrFull) {
+		t.Error("expected ErrFull; got", err)
+	}
+
+	leave()
+	if err := <-entered; err != nil {
+		t.Error("expected the queued call to run; got", err)
+	}
+	if n := b.InFlight(); n != 0 {
+		t.Errorf("expected no call in flight; got %d", n)
+	}
+}
+
+// TestBulkheadQueueTimeout tests whether a queued call gives up after the
+// queue timeout, or once its context is done.
+func TestBulkheadQueueTimeout(t *testing.T) {
+	b := New(1, 2, 20*time.Millisecond)
+
+	leave, err := b.Enter(context.Background())
+	if err != nil {
+		t.Fatal("expected the first call to run; got", err)
+	}
+	defer leave()
+
+	if _, err := b.Enter(context.Background()); !errors.Is(err, ErrTimeout) {
+		t.Error("expected ErrTimeout; got", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Enter(ctx); !errors.Is(err, context.Canceled) {
+		t.Error("expected context.Canceled; got", err)
+	}
+	if n := b.Queued(); n != 0 {
+		t.Errorf("expected an empty queue; got %d", n)
+	}
+}
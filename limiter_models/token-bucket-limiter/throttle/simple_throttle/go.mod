@@ -1,3 +1,7 @@
 module simple_throttle
 
 go 1.18
+
+require bulkhead v0.0.0
+
+replace bulkhead => ../bulkhead
@@ -0,0 +1,28 @@
+package simple_throttle
+
+import "bulkhead"
+
+// Bulkhead caps the calls in flight; see package bulkhead.
+type Bulkhead = bulkhead.Bulkhead
+
+// NewBulkhead returns a Bulkhead that lets maxInFlight calls run at once,
+// and queues queueSize more for at most queueTimeout.
+var NewBulkhead = bulkhead.New
+
+var (
+	// ErrBulkheadFull is returned when the calls in flight and the queue of
+	// the Bulkhead are both full. Unlike ErrTooManyCalls, it means the
+	// wrapped function is slow, not that it is called too often.
+	ErrBulkheadFull = bulkhead.ErrFull
+	// ErrBulkheadTimeout is returned by a call that waited in the queue of
+	// the Bulkhead for longer than its queue timeout.
+	ErrBulkheadTimeout = bulkhead.ErrTimeout
+)
+
+// WithBulkhead lets the calls that got a token through b.
+// The token is spent even if b then rejects the call.
+func WithBulkhead(b *Bulkhead) Option {
+	return func(t *Throttler) {
+		t.bulkhead = b
+	}
+}
@@ -2,7 +2,10 @@ package simple_throttle
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -159,6 +162,374 @@ func TestThrottleContextTimeout(t *testing.T) {
 	}
 }
 
+// TestThrottleRefillOutlivesFirstContext tests whether the bucket keeps
+// refilling after the context of the first call is canceled.
+func TestThrottleRefillOutlivesFirstContext(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	throttle := Throttle(effector, 1, 1, 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, e := throttle(ctx); e != nil {
+		t.Fatal("unexpected error:", e)
+	}
+	cancel()
+
+	// Wait for a few refills
+	time.Sleep(200 * time.Millisecond)
+
+	if _, e := throttle(context.Background()); e != nil {
+		t.Error("bucket was not refilled:", e)
+	}
+
+	if callsCounter != 2 {
+		t.Error("expected 2; got", callsCounter)
+	}
+}
+
+// TestThrottlerClose tests whether Close releases the refill goroutine
+// and fails later calls.
+func TestThrottlerClose(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	throttler := NewThrottler(1, 1, 10*time.Millisecond)
+	throttle := Wrap(throttler, effector)
+
+	ctx := context.Background()
+	if _, e := throttle(ctx); e != nil {
+		t.Fatal("unexpected error:", e)
+	}
+
+	running := runtime.NumGoroutine()
+	throttler.Close()
+	throttler.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() >= running {
+		if time.Now().After(deadline) {
+			t.Fatal("refill goroutine still running after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, e := throttle(ctx); !errors.Is(e, ErrClosed) {
+		t.Error("expected ErrClosed; got", e)
+	}
+
+	if callsCounter != 1 {
+		t.Error("expected 1; got", callsCounter)
+	}
+}
+
+// TestThrottleStrategyError tests whether the error strategy fails calls
+// made while the bucket is empty.
+func TestThrottleStrategyError(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	ctx := context.Background()
+	throttle := Throttle(effector, 1, 1, time.Second, WithStrategy(StrategyError))
+
+	if _, e := throttle(ctx); e != nil {
+		t.Fatal("unexpected error:", e)
+	}
+
+	if _, e := throttle(ctx); !errors.Is(e, ErrTooManyCalls) {
+		t.Error("expected ErrTooManyCalls; got", e)
+	}
+
+	if callsCounter != 1 {
+		t.Error("expected 1; got", callsCounter)
+	}
+}
+
+// TestThrottleStrategyDelay tests whether the delay strategy waits for
+// the next refill instead of failing.
+func TestThrottleStrategyDelay(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	ctx := context.Background()
+	throttle := Throttle(effector, 1, 1, 100*time.Millisecond, WithStrategy(StrategyDelay))
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, e := throttle(ctx); e != nil {
+			t.Fatal("unexpected error:", e)
+		}
+	}
+	elapsed := time.Since(start)
+
+	if callsCounter != 3 {
+		t.Error("expected 3; got", callsCounter)
+	}
+
+	if elapsed < 150*time.Millisecond {
+		t.Error("expected to wait for 2 refills; waited", elapsed)
+	}
+}
+
+// TestThrottleStrategyDelayContextTimeout tests whether a delayed call
+// gives up when its context is done.
+func TestThrottleStrategyDelayContextTimeout(t *testing.T) {
+	callsCounter := 0
+	effector := callsCountFunction(&callsCounter)
+
+	throttle := Throttle(effector, 1, 1, time.Second, WithStrategy(StrategyDelay))
+
+	if _, e := throttle(context.Background()); e != nil {
+		t.Fatal("unexpected error:", e)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, e := throttle(ctx)
+	if !errors.Is(e, context.DeadlineExceeded) {
+		t.Error("expected context.DeadlineExceeded; got", e)
+	}
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("call was not released by its context; waited", elapsed)
+	}
+
+	if callsCounter != 1 {
+		t.Error("expected 1; got", callsCounter)
+	}
+}
+
+// TestThrottleStrategyLatestWins tests whether only the most recent of
+// the calls made during a cooldown runs.
+func TestThrottleStrategyLatestWins(t *testing.T) {
+	var outputs []string
+	var m sync.Mutex
+	effector := func(ctx context.Context) (string, error) {
+		m.Lock()
+		defer m.Unlock()
+		outputs = append(outputs, ctx.Value(callKey{}).(string))
+		return "", nil
+	}
+
+	throttle := Throttle(effector, 1, 1, 200*time.Millisecond, WithStrategy(StrategyLatestWins))
+
+	if _, e := throttle(context.WithValue(context.Background(), callKey{}, "first")); e != nil {
+		t.Fatal("unexpected error:", e)
+	}
+
+	names := []string{"a", "b", "c"}
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, errs[i] = throttle(context.WithValue(context.Background(), callKey{}, name))
+		}(i, name)
+
+		// Let the call reach the throttle before making the next one.
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, name := range names[:2] {
+		if !errors.Is(errs[i], ErrSuperseded) {
+			t.Errorf("expected ErrSuperseded for %s; got %v", name, errs[i])
+		}
+	}
+	if errs[2] != nil {
+		t.Error("unexpected error for c:", errs[2])
+	}
+
+	if fmt.Sprint(outputs) != "[first c]" {
+		t.Error("expected [first c]; got", outputs)
+	}
+}
+
+type callKey struct{}
+
+// TestThrottleGenericResult tests whether results of any type go through
+// the throttle untouched.
+func TestThrottleGenericResult(t *testing.T) {
+	callsCounter := 0
+	effector := func(ctx context.Context) (int, error) {
+		callsCounter++
+		return callsCounter * 10, nil
+	}
+
+	ctx := context.Background()
+	throttle := Throttle(effector, 1, 1, time.Second)
+
+	n, e := throttle(ctx)
+	if e != nil || n != 10 {
+		t.Errorf("expected 10, <nil>; got %d, %v", n, e)
+	}
+
+	n, e = throttle(ctx)
+	if !errors.Is(e, ErrTooManyCalls) || n != 0 {
+		t.Errorf("expected 0, %v; got %d, %v", ErrTooManyCalls, n, e)
+	}
+}
+
+// TestThrottleErr tests the variant for functions that return only an error.
+func TestThrottleErr(t *testing.T) {
+	callsCounter := 0
+	failure := errors.New("failure")
+	effector := func(ctx context.Context) error {
+		callsCounter++
+		return failure
+	}
+
+	ctx := context.Background()
+	throttle := ThrottleErr(effector, 1, 1, time.Second)
+
+	if e := throttle(ctx); !errors.Is(e, failure) {
+		t.Error("expected the effector's error; got", e)
+	}
+
+	if e := throttle(ctx); !errors.Is(e, ErrTooManyCalls) {
+		t.Error("expected ErrTooManyCalls; got", e)
+	}
+
+	if callsCounter != 1 {
+		t.Error("expected 1; got", callsCounter)
+	}
+}
+
+// TestThrottleArg tests the variant for functions that take an argument,
+// sharing one Throttler with a function that takes none.
+func TestThrottleArg(t *testing.T) {
+	throttler := NewThrottler(2, 1, time.Second)
+	defer throttler.Close()
+
+	double := WrapArg(throttler, func(ctx context.Context, n int) (int, error) {
+		return 2 * n, nil
+	})
+	hello := Wrap(throttler, func(ctx context.Context) (string, error) {
+		return "hello", nil
+	})
+
+	ctx := context.Background()
+	if n, e := double(ctx, 21); e != nil || n != 42 {
+		t.Errorf("expected 42, <nil>; got %d, %v", n, e)
+	}
+
+	if s, e := hello(ctx); e != nil || s != "hello" {
+		t.Errorf("expected hello, <nil>; got %s, %v", s, e)
+	}
+
+	if _, e := double(ctx, 1); !errors.Is(e, ErrTooManyCalls) {
+		t.Error("expected ErrTooManyCalls; got", e)
+	}
+}
+
+// blockingFunction returns an effector that runs until release is closed.
+func blockingFunction(release chan struct{}) Effector {
+	return func(ctx context.Context) (string, error) {
+		<-release
+		return "done", nil
+	}
+}
+
+// waitFor polls cond until it is true, or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+}
+
+// TestThrottleBulkhead tests whether calls beyond the bulkhead's limit are
+// queued, then rejected with errors that aren't ErrTooManyCalls.
+func TestThrottleBulkhead(t *testing.T) {
+	release := make(chan struct{})
+	bulkhead := NewBulkhead(1, 1, 50*time.Millisecond)
+	throttle := Throttle(blockingFunction(release), 10, 1, time.Second, WithBulkhead(bulkhead))
+
+	ctx := context.Background()
+	first := make(chan error)
+	go func() {
+		_, e := throttle(ctx)
+		first <- e
+	}()
+	waitFor(t, "the first call to run", func() bool { return bulkhead.InFlight() == 1 })
+
+	queued := make(chan error)
+	go func() {
+		_, e := throttle(ctx)
+		queued <- e
+	}()
+	waitFor(t, "the second call to queue", func() bool { return bulkhead.Queued() == 1 })
+
+	if _, e := throttle(ctx); !errors.Is(e, ErrBulkheadFull) || errors.Is(e, ErrTooManyCalls) {
+		t.Error("expected ErrBulkheadFull; got", e)
+	}
+
+	if e := <-queued; !errors.Is(e, ErrBulkheadTimeout) {
+		t.Error("expected ErrBulkheadTimeout; got", e)
+	}
+	if n := bulkhead.Queued(); n != 0 {
+		t.Error("expected 0 queued; got", n)
+	}
+
+	close(release)
+	if e := <-first; e != nil {
+		t.Error("unexpected error:", e)
+	}
+	if n := bulkhead.InFlight(); n != 0 {
+		t.Error("expected 0 in flight; got", n)
+	}
+
+	if _, e := throttle(ctx); e != nil {
+		t.Error("unexpected error:", e)
+	}
+}
+
+// TestThrottleBulkheadQueue tests whether a queued call runs once a call in
+// flight is done, and whether a Bulkhead caps the Throttlers sharing it.
+func TestThrottleBulkheadQueue(t *testing.T) {
+	release := make(chan struct{})
+	bulkhead := NewBulkhead(1, 1, 0)
+	slow := Throttle(blockingFunction(release), 10, 1, time.Second, WithBulkhead(bulkhead))
+	fast := Throttle(func(ctx context.Context) (string, error) {
+		return "fast", nil
+	}, 10, 1, time.Second, WithBulkhead(bulkhead))
+
+	ctx := context.Background()
+	first := make(chan error)
+	go func() {
+		_, e := slow(ctx)
+		first <- e
+	}()
+	waitFor(t, "the slow call to run", func() bool { return bulkhead.InFlight() == 1 })
+
+	queued := make(chan string)
+	go func() {
+		s, _ := fast(ctx)
+		queued <- s
+	}()
+	waitFor(t, "the fast call to queue", func() bool { return bulkhead.Queued() == 1 })
+
+	select {
+	case s := <-queued:
+		t.Fatal("expected the fast call to wait; got", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if s := <-queued; s != "fast" {
+		t.Error("expected fast; got", s)
+	}
+	if e := <-first; e != nil {
+		t.Error("unexpected error:", e)
+	}
+}
+
 // 1. Windows platform.
 // 2. Run each individual test from Visual Code ide:
 // =================================================
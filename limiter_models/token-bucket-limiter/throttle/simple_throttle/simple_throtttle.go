@@ -2,68 +2,297 @@ package simple_throttle
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"sync"
 	"time"
 )
 
-type Effector func(context.Context) (string, error)
+// Func is a function that can be throttled; T is the type of its result.
+type Func[T any] func(context.Context) (T, error)
 
-// basic “token bucket” algorithm that uses the “error” strategy:
-func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
-	var tokens = max
-	var once sync.Once
-	var m sync.Mutex
+// ErrFunc is a throttled function that only reports an error.
+type ErrFunc func(context.Context) error
 
-	return func(ctx context.Context) (string, error) {
-		if ctx.Err() != nil {
-			return "", ctx.Err()
-		}
+// ArgFunc is a throttled function that takes an argument of type A.
+type ArgFunc[A, T any] func(context.Context, A) (T, error)
+
+// Effector is the string-returning Func the package started with.
+type Effector = Func[string]
+
+var (
+	// ErrTooManyCalls is returned when the bucket is out of tokens.
+	ErrTooManyCalls = errors.New("too many calls")
+	// ErrSuperseded is returned by a call held by the LatestWins strategy
+	// when a more recent call takes its place.
+	ErrSuperseded = errors.New("superseded by a later call")
+	// ErrClosed is returned by calls made after the Throttler was closed.
+	ErrClosed = errors.New("throttle closed")
+)
+
+// Strategy decides what happens to a call when the bucket is empty.
+type Strategy int
+
+const (
+	// StrategyError fails the call with ErrTooManyCalls. It is the default.
+	StrategyError Strategy = iota
+	// StrategyDelay blocks the call until a token arrives or its context is done.
+	StrategyDelay
+	// StrategyLatestWins holds the call until a token arrives. A call made in
+	// the meantime takes its place, and the held call fails with ErrSuperseded,
+	// so only the most recent call of a cooldown runs.
+	StrategyLatestWins
+)
+
+// Option configures a Throttler.
+type Option func(*Throttler)
+
+// WithStrategy selects how calls are handled when the bucket is empty.
+func WithStrategy(s Strategy) Option {
+	return func(t *Throttler) {
+		t.strategy = s
+	}
+}
+
+// Throttler is a token bucket that holds max tokens and is refilled
+// with refill tokens every d by its own goroutine, whatever the contexts
+// of the calls going through it. Close stops that goroutine.
+type Throttler struct {
+	max      uint
+	refill   uint
+	d        time.Duration
+	strategy Strategy
+	bulkhead *Bulkhead
+	tokens   uint
+	m        sync.Mutex
+
+	// refilled is closed, and replaced, every time tokens are added.
+	refilled chan struct{}
+	// latest is the call held by StrategyLatestWins; closing it supersedes that call.
+	latest chan struct{}
+
+	once      sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewThrottler returns a full bucket. Refilling starts with the first call.
+func NewThrottler(max uint, refill uint, d time.Duration, opts ...Option) *Throttler {
+	t := &Throttler{
+		max:      max,
+		refill:   refill,
+		d:        d,
+		tokens:   max,
+		refilled: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
 
-		once.Do(func() {									// <---- once exec, inside passed anonym func() is lock/unlock
-			ticker := time.NewTicker(d)                     // <---- ticker timer
-
-			go func() {
-				defer ticker.Stop()
-
-				for {
-					select {
-					case <-ctx.Done():
-						return
-
-					case <-ticker.C:
-						m.Lock()						//<----- LOCK
-						t := tokens + refill
-						if t > max {
-							t = max
-						}
-						tokens = t
-						m.Unlock()                      //<---- UNLOCK
-					}
+	return t
+}
+
+// run refills the bucket until the throttler is closed.
+func (t *Throttler) run() {
+	ticker := time.NewTicker(t.d) // <---- ticker timer, owned by the throttler and not by a request
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.done:
+				return
+
+			case <-ticker.C:
+				t.m.Lock() //<----- LOCK
+				tokens := t.tokens + t.refill
+				if tokens > t.max {
+					tokens = t.max
 				}
-			}()
-		})
+				t.tokens = tokens
+				close(t.refilled) // <---- wake up the waiting calls
+				t.refilled = make(chan struct{})
+				t.m.Unlock() //<---- UNLOCK
+			}
+		}
+	}()
+}
 
-		m.Lock()
-		defer m.Unlock()
+// Close stops the refill goroutine. Calls made afterwards, and calls
+// waiting for a token, fail with ErrClosed.
+// It is safe to call Close more than once.
+func (t *Throttler) Close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+}
 
-		if tokens <= 0 {
-			return "", fmt.Errorf("too many calls")
+// Wrap returns a Func that spends one token of t before calling e.
+func Wrap[T any](t *Throttler, e Func[T]) Func[T] {
+	return func(ctx context.Context) (T, error) {
+		release, err := t.acquire(ctx)
+		if err != nil {
+			var zero T
+			return zero, err
 		}
+		defer release()
+
+		return e(ctx)
+	}
+}
 
-		tokens--
+// WrapErr is Wrap for functions that return only an error.
+func WrapErr(t *Throttler, e ErrFunc) ErrFunc {
+	return func(ctx context.Context) error {
+		release, err := t.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
 
 		return e(ctx)
 	}
 }
+
+// WrapArg is Wrap for functions that take an argument.
+// With StrategyLatestWins, the argument of the most recent call is the one used.
+func WrapArg[A, T any](t *Throttler, e ArgFunc[A, T]) ArgFunc[A, T] {
+	return func(ctx context.Context, arg A) (T, error) {
+		release, err := t.acquire(ctx)
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		defer release()
+
+		return e(ctx, arg)
+	}
+}
+
+// acquire checks ctx, spends one token, then enters the bulkhead if any.
+// The returned function must be called once the call is done.
+func (t *Throttler) acquire(ctx context.Context) (func(), error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	if err := t.take(ctx); err != nil {
+		return nil, err
+	}
+
+	if t.bulkhead == nil {
+		return func() {}, nil
+	}
+	return t.bulkhead.Enter(ctx)
+}
+
+// take spends one token, applying the strategy of t when there is none left.
+func (t *Throttler) take(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return ErrClosed
+	default:
+	}
+
+	t.once.Do(t.run)
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	var turn chan struct{}
+	if t.strategy == StrategyLatestWins {
+		// Whether or not there is a token for us, we are now the latest call.
+		if t.latest != nil {
+			close(t.latest)
+			t.latest = nil
+		}
+		if t.tokens <= 0 {
+			turn = make(chan struct{})
+			t.latest = turn
+		}
+	}
+
+	for t.tokens <= 0 {
+		if t.strategy == StrategyError {
+			return ErrTooManyCalls
+		}
+
+		refilled := t.refilled
+		t.m.Unlock()
+		select {
+		case <-refilled:
+		case <-turn:
+		case <-ctx.Done():
+		case <-t.done:
+		}
+		t.m.Lock()
+
+		switch {
+		case turn != nil && t.latest != turn:
+			return ErrSuperseded
+		case ctx.Err() != nil:
+			t.forget(turn)
+			return ctx.Err()
+		case isDone(t.done):
+			t.forget(turn)
+			return ErrClosed
+		}
+	}
+
+	t.forget(turn)
+	t.tokens--
+	return nil
+}
+
+// forget clears the held call if it is still turn.
+func (t *Throttler) forget(turn chan struct{}) {
+	if turn != nil && t.latest == turn {
+		t.latest = nil
+	}
+}
+
+func isDone(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// basic “token bucket” algorithm that uses the “error” strategy, unless
+// another one is selected with WithStrategy.
+// The refill goroutine of the returned Func runs for the life of the program;
+// use NewThrottler and Wrap when it needs to be stopped.
+func Throttle[T any](e Func[T], max uint, refill uint, d time.Duration, opts ...Option) Func[T] {
+	return Wrap(NewThrottler(max, refill, d, opts...), e)
+}
+
+// ThrottleErr is Throttle for functions that return only an error.
+func ThrottleErr(e ErrFunc, max uint, refill uint, d time.Duration, opts ...Option) ErrFunc {
+	return WrapErr(NewThrottler(max, refill, d, opts...), e)
+}
+
+// ThrottleArg is Throttle for functions that take an argument.
+func ThrottleArg[A, T any](e ArgFunc[A, T], max uint, refill uint, d time.Duration, opts ...Option) ArgFunc[A, T] {
+	return WrapArg(NewThrottler(max, refill, d, opts...), e)
+}
+
 // ==========================================
 // simple_throttle rate-limitter algorithm:
 // ==========================================
-// - Throttle function wraps the effector function e with a closure 
-// that contains the rate-limiting logic. 
-// - The bucket is initially allocated max tokens; 
-//   each time the closure is triggered it checks whether it has any remaining tokens. 
-// - If tokens are available, it decrements the token count by one and 
-//   triggers the effector function. 
-// - If not, an error is returned. 
-// - Tokens are added at a rate of refill tokens every duration d.
+// - Throttle function (or ThrottleErr, ThrottleArg) wraps the effector function e with a closure
+// that contains the rate-limiting logic.
+// - The bucket is initially allocated max tokens;
+//   each time the closure is triggered it checks whether it has any remaining tokens.
+// - If tokens are available, it decrements the token count by one and
+//   triggers the effector function.
+// - If not, the strategy decides:
+//   StrategyError returns an error, StrategyDelay waits for a token,
+//   StrategyLatestWins waits for a token unless a later call replaces it.
+// - Tokens are added at a rate of refill tokens every duration d,
+//   by a goroutine that belongs to the Throttler and stops on Close.
+// - With WithBulkhead, a call that got its token also needs a slot of the
+//   Bulkhead, which caps the calls in flight whatever the rate.
@@ -2,4 +2,9 @@ module throttle_token_bucket
 
 go 1.18
 
-require github.com/gorilla/mux v1.8.0
+require (
+	bulkhead v0.0.0
+	github.com/gorilla/mux v1.8.0
+)
+
+replace bulkhead => ../bulkhead
@@ -14,72 +14,364 @@
  * limitations under the License.
  */
 
- package main
-
- import (
-	 "context"
-	 "time"
- )
- 
- // Effector is the function that you want to subject to throttling.
- type Effector func(context.Context) (string, error)
- 
- // Throttled wraps an Effector. It accepts the same parameters, plus a
- // "uid" string that represents a caller identity. It returns the same,
- // plus a bool that's true if the call is not throttled.
- type Throttled func(context.Context, string) (bool, string, error)
- 
- // A bucket tracks the requests associated with a uid.
- type bucket struct {
-	 tokens uint
-	 time   time.Time
- }
- 
- // Throttle accepts an Effector function, and returns a Throttled
- // function with a per-uid token bucket with a capacity of max
- // that refills at a rate of refill tokens every d.
- func Throttle(e Effector, max uint, refill uint, d time.Duration) Throttled {
-	 // buckets maps uids to specific buckets
-	 buckets := map[string]*bucket{}
- 
-	 return func(ctx context.Context, uid string) (bool, string, error) {
-		 b := buckets[uid]
- 
-		 // This is a new entry! It passes. Assumes that capacity >= 1.
-		 if b == nil {
-			 buckets[uid] = &bucket{tokens: max - 1, time: time.Now()}
- 
-			 str, err := e(ctx)
-			 return true, str, err
-		 }
- 
-		 // Calculate how many tokens we now have based on the time
-		 // passed since the previous request.
-		 refillsSince := uint(time.Since(b.time) / d)
-		 tokensAddedSince := refill * refillsSince
-		 currentTokens := b.tokens + tokensAddedSince
- 
-		 // We don't have enough tokens. Return false.
-		 if currentTokens < 1 {
-			 return false, "", nil
-		 }
- 
-		 // If we've refilled our bucket, we can restart the clock.
-		 // Otherwise, we figure out when the most recent tokens were added.
-		 if currentTokens > max {
-			 b.time = time.Now()
-			 b.tokens = max - 1
-		 } else {
-			 deltaTokens := currentTokens - b.tokens
-			 deltaRefills := deltaTokens / refill
-			 deltaTime := time.Duration(deltaRefills) * d
- 
-			 b.time = b.time.Add(deltaTime)
-			 b.tokens = currentTokens - 1
-		 }
- 
-		 str, err := e(ctx)
- 
-		 return true, str, err
-	 }
- }
\ No newline at end of file
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Effector is the function that you want to subject to throttling.
+// T is the type of its result.
+type Effector[T any] func(context.Context) (T, error)
+
+// Throttled wraps an Effector. It accepts the same parameters, plus a
+// "uid" string that represents a caller identity. It returns the same,
+// plus a Result whose Allowed field is true if the call is not throttled.
+type Throttled[T any] func(context.Context, string) (Result, T, error)
+
+// ErrEffector is an Effector that only reports an error.
+type ErrEffector func(context.Context) error
+
+// ThrottledErr wraps an ErrEffector the way Throttled wraps an Effector.
+type ThrottledErr func(context.Context, string) (Result, error)
+
+// ArgEffector is an Effector that takes an argument of type A.
+type ArgEffector[A, T any] func(context.Context, A) (T, error)
+
+// ThrottledArg wraps an ArgEffector the way Throttled wraps an Effector.
+type ThrottledArg[A, T any] func(context.Context, string, A) (Result, T, error)
+
+// Result is the state of a uid's bucket once a call has been let through,
+// or throttled. It carries what a server needs for rate limit headers.
+type Result struct {
+	// Allowed is true if the call is not throttled.
+	Allowed bool
+	// Limit is the capacity of the bucket.
+	Limit uint
+	// Remaining is the number of tokens left after the call.
+	Remaining uint
+	// ResetAt is when the bucket will be full again.
+	ResetAt time.Time
+	// RetryAfter is how long a throttled caller has to wait for the
+	// next token. It is 0 when the call is allowed.
+	RetryAfter time.Duration
+	// WouldThrottle is true if the call was let through by a DryRun,
+	// but would have been throttled otherwise.
+	WouldThrottle bool
+}
+
+// DefaultMaxUIDs is the number of buckets kept when WithMaxUIDs isn't used.
+const DefaultMaxUIDs = 65536
+
+// Option configures the buckets behind a Throttled function.
+type Option func(*buckets)
+
+// WithMaxUIDs caps the number of buckets. When a new uid comes in and the
+// cap is reached, the least recently used bucket is dropped. A value <= 0
+// removes the cap.
+func WithMaxUIDs(n int) Option {
+	return func(bs *buckets) {
+		bs.maxUIDs = n
+	}
+}
+
+// WithIdleTimeout drops buckets that haven't been used for d. It defaults
+// to the time an empty bucket takes to refill, after which dropping it
+// loses nothing: a new bucket starts full too.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(bs *buckets) {
+		bs.idle = d
+		bs.idleSet = true
+	}
+}
+
+// withClock replaces time.Now, for tests.
+func withClock(now func() time.Time) Option {
+	return func(bs *buckets) {
+		bs.now = now
+	}
+}
+
+// A bucket tracks the requests associated with a uid.
+type bucket struct {
+	uid    string
+	tokens uint
+	time   time.Time
+	used   time.Time // last request, for idle eviction
+	limits limits    // those tokens and time are counted in
+}
+
+// buckets maps uids to specific buckets with a capacity of max
+// that refill at a rate of refill tokens every d. It is safe for
+// concurrent use. Idle buckets are dropped lazily, on the next take,
+// so no goroutine is needed to keep the map bounded.
+type buckets struct {
+	max     uint
+	refill  uint
+	d       time.Duration
+	maxUIDs int
+	idle    time.Duration
+	idleSet bool
+	now     func() time.Time
+
+	schedule *Schedule
+	bulkhead *Bulkhead
+	dryRun   *DryRun
+
+	mu  sync.Mutex
+	m   map[string]*list.Element
+	lru *list.List // of *bucket, most recently used first
+}
+
+func newBuckets(max uint, refill uint, d time.Duration, opts ...Option) *buckets {
+	bs := &buckets{
+		max:     max,
+		refill:  refill,
+		d:       d,
+		maxUIDs: DefaultMaxUIDs,
+		idle:    refillTime(max, refill, d),
+		now:     time.Now,
+		m:       map[string]*list.Element{},
+		lru:     list.New(),
+	}
+
+	for _, opt := range opts {
+		opt(bs)
+	}
+
+	if bs.schedule != nil && !bs.idleSet {
+		if idle := bs.schedule.idle(); idle > bs.idle {
+			bs.idle = idle
+		}
+	}
+
+	return bs
+}
+
+// limitsAt returns the limits of the buckets at now.
+func (bs *buckets) limitsAt(now time.Time) limits {
+	if bs.schedule != nil {
+		if l, ok := bs.schedule.at(now); ok {
+			return l
+		}
+	}
+	return limits{max: bs.max, refill: bs.refill, d: bs.d}
+}
+
+// refillTime is how long it takes to add n tokens to a bucket, or 0 if it never refills.
+func refillTime(n uint, refill uint, d time.Duration) time.Duration {
+	if refill == 0 {
+		return 0
+	}
+	return d * time.Duration((n+refill-1)/refill)
+}
+
+// take spends a token from the bucket of uid. The Result isn't Allowed if
+// the bucket is empty.
+func (bs *buckets) take(uid string) Result {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := bs.now()
+	bs.evictIdle(now)
+	l := bs.limitsAt(now)
+
+	e := bs.m[uid]
+
+	// This is a new entry! It passes. Assumes that capacity >= 1.
+	if e == nil {
+		if bs.maxUIDs > 0 && len(bs.m) >= bs.maxUIDs {
+			bs.remove(bs.lru.Back())
+		}
+		b := &bucket{uid: uid, tokens: l.max - 1, time: now, used: now, limits: l}
+		bs.m[uid] = bs.lru.PushFront(b)
+		return bs.result(b, true, now)
+	}
+
+	b := bs.use(e, l, now)
+
+	// We don't have enough tokens. The call is throttled.
+	if b.tokens < 1 {
+		return bs.result(b, false, now)
+	}
+
+	b.tokens--
+	return bs.result(b, true, now)
+}
+
+// peek tells whether the bucket of uid has a token, without spending it.
+// A uid without a bucket gets none: it would start full.
+func (bs *buckets) peek(uid string) Result {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	now := bs.now()
+	bs.evictIdle(now)
+	l := bs.limitsAt(now)
+
+	e := bs.m[uid]
+	if e == nil {
+		return Result{Allowed: true, Limit: l.max, Remaining: l.max, ResetAt: now}
+	}
+
+	b := bs.use(e, l, now)
+	return bs.result(b, b.tokens >= 1, now)
+}
+
+// use marks the bucket of e as used at now, and brings it up to date
+// with the limits l.
+func (bs *buckets) use(e *list.Element, l limits, now time.Time) *bucket {
+	b := e.Value.(*bucket)
+	b.used = now
+	bs.lru.MoveToFront(e)
+
+	if b.limits != l {
+		b.rescale(l, now)
+	}
+	b.refillTo(now)
+	return b
+}
+
+// refillTo adds the tokens b got since b.time, up to its capacity.
+func (b *bucket) refillTo(now time.Time) {
+	l := b.limits
+
+	// Calculate how many tokens we now have based on the time
+	// passed since the previous request.
+	refillsSince := uint(now.Sub(b.time) / l.d)
+	currentTokens := b.tokens + l.refill*refillsSince
+
+	// If we've refilled our bucket, we can restart the clock.
+	// Otherwise, we figure out when the most recent tokens were added.
+	if currentTokens > l.max {
+		b.time = now
+		b.tokens = l.max
+	} else {
+		b.time = b.time.Add(time.Duration(refillsSince) * l.d)
+		b.tokens = currentTokens
+	}
+}
+
+// result describes b, which holds no more tokens than counted in b.tokens
+// until its next refill at b.time + d.
+func (bs *buckets) result(b *bucket, allowed bool, now time.Time) Result {
+	l := b.limits
+	res := Result{
+		Allowed:   allowed,
+		Limit:     l.max,
+		Remaining: b.tokens,
+		ResetAt:   b.time.Add(refillTime(l.max-b.tokens, l.refill, l.d)),
+	}
+	if !allowed {
+		res.RetryAfter = b.time.Add(l.d).Sub(now)
+	}
+	return res
+}
+
+// evictIdle drops the buckets that haven't been used since now - idle.
+func (bs *buckets) evictIdle(now time.Time) {
+	if bs.idle <= 0 {
+		return
+	}
+
+	for e := bs.lru.Back(); e != nil; e = bs.lru.Back() {
+		if now.Sub(e.Value.(*bucket).used) < bs.idle {
+			return
+		}
+		bs.remove(e)
+	}
+}
+
+func (bs *buckets) remove(e *list.Element) {
+	delete(bs.m, e.Value.(*bucket).uid)
+	bs.lru.Remove(e)
+}
+
+// enter lets a call that got a token through the bulkhead, if any.
+// The returned function must be called once the call is done.
+func (bs *buckets) enter(ctx context.Context) (func(), error) {
+	if bs.bulkhead == nil {
+		return func() {}, nil
+	}
+	return bs.bulkhead.Enter(ctx)
+}
+
+// len returns the number of buckets currently kept.
+func (bs *buckets) len() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	return len(bs.m)
+}
+
+// Throttle accepts an Effector function, and returns a Throttled
+// function with a per-uid token bucket with a capacity of max
+// that refills at a rate of refill tokens every d. The returned
+// function is safe for concurrent use.
+func Throttle[T any](e Effector[T], max uint, refill uint, d time.Duration, opts ...Option) Throttled[T] {
+	bs := newBuckets(max, refill, d, opts...)
+
+	return func(ctx context.Context, uid string) (Result, T, error) {
+		r := bs.dryRun.check(bs.take(uid))
+		if !r.Allowed {
+			var zero T
+			return r, zero, nil
+		}
+
+		release, err := bs.enter(ctx)
+		if err != nil {
+			var zero T
+			return r, zero, err
+		}
+		defer release()
+
+		res, err := e(ctx)
+		return r, res, err
+	}
+}
+
+// ThrottleErr is Throttle for functions that return only an error.
+func ThrottleErr(e ErrEffector, max uint, refill uint, d time.Duration, opts ...Option) ThrottledErr {
+	bs := newBuckets(max, refill, d, opts...)
+
+	return func(ctx context.Context, uid string) (Result, error) {
+		r := bs.dryRun.check(bs.take(uid))
+		if !r.Allowed {
+			return r, nil
+		}
+
+		release, err := bs.enter(ctx)
+		if err != nil {
+			return r, err
+		}
+		defer release()
+
+		return r, e(ctx)
+	}
+}
+
+// ThrottleArg is Throttle for functions that take an argument.
+func ThrottleArg[A, T any](e ArgEffector[A, T], max uint, refill uint, d time.Duration, opts ...Option) ThrottledArg[A, T] {
+	bs := newBuckets(max, refill, d, opts...)
+
+	return func(ctx context.Context, uid string, arg A) (Result, T, error) {
+		r := bs.dryRun.check(bs.take(uid))
+		if !r.Allowed {
+			var zero T
+			return r, zero, nil
+		}
+
+		release, err := bs.enter(ctx)
+		if err != nil {
+			var zero T
+			return r, zero, err
+		}
+		defer release()
+
+		res, err := e(ctx, arg)
+		return r, res, err
+	}
+}
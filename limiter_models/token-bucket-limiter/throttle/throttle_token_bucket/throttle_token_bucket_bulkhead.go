@@ -0,0 +1,31 @@
+package main
+
+import "bulkhead"
+
+// Bulkhead caps the calls in flight; see package bulkhead. It is shared by
+// all the uids of a Throttled function, and can be shared by several
+// Throttled functions to cap them together.
+type Bulkhead = bulkhead.Bulkhead
+
+// NewBulkhead returns a Bulkhead that lets maxInFlight calls run at once,
+// and queues queueSize more for at most queueTimeout.
+var NewBulkhead = bulkhead.New
+
+var (
+	// ErrBulkheadFull is returned when the calls in flight and the queue of
+	// the Bulkhead are both full. Unlike a throttled call, whose Result isn't
+	// Allowed, it means the Effector is slow, not that it is called too often.
+	ErrBulkheadFull = bulkhead.ErrFull
+	// ErrBulkheadTimeout is returned by a call that waited in the queue of
+	// the Bulkhead for longer than its queue timeout.
+	ErrBulkheadTimeout = bulkhead.ErrTimeout
+)
+
+// WithBulkhead lets the calls that got a token through b. The token is
+// spent even if b then rejects the call: its Result is Allowed, and the
+// error is ErrBulkheadFull or ErrBulkheadTimeout.
+func WithBulkhead(b *Bulkhead) Option {
+	return func(bs *buckets) {
+		bs.bulkhead = b
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "sync/atomic"
+
+// DryRun is a switch that stops Throttled functions from throttling,
+// without losing track of what they would do: while it is on, a call that
+// would be throttled is let through with a Result whose WouldThrottle
+// field is set, and counted. It can be flipped at any time, e.g. to try
+// out a new limit in production before enforcing it.
+type DryRun struct {
+	on            int32
+	wouldThrottle uint64
+}
+
+// NewDryRun returns a DryRun switch, on or off.
+func NewDryRun(on bool) *DryRun {
+	d := &DryRun{}
+	d.Set(on)
+	return d
+}
+
+// WithDryRun lets the calls through while d is on.
+func WithDryRun(d *DryRun) Option {
+	return func(bs *buckets) {
+		bs.dryRun = d
+	}
+}
+
+// Set turns d on or off.
+func (d *DryRun) Set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&d.on, v)
+}
+
+// On reports whether d is on. A nil DryRun is off.
+func (d *DryRun) On() bool {
+	return d != nil && atomic.LoadInt32(&d.on) == 1
+}
+
+// WouldThrottle returns the number of calls let through that would
+// have been throttled otherwise.
+func (d *DryRun) WouldThrottle() uint64 {
+	return atomic.LoadUint64(&d.wouldThrottle)
+}
+
+// check lets r through if it is throttled while d is on.
+func (d *DryRun) check(r Result) Result {
+	if r.Allowed || !d.On() {
+		return r
+	}
+
+	atomic.AddUint64(&d.wouldThrottle, 1)
+	r.Allowed = true
+	r.WouldThrottle = true
+	return r
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Failure tells whether a response status counts against the client.
+type Failure func(status int) bool
+
+// StatusIn is a Failure for the given statuses, e.g. StatusIn(401, 403)
+// against password guessing.
+func StatusIn(statuses ...int) Failure {
+	set := make(map[int]bool, len(statuses))
+	for _, s := range statuses {
+		set[s] = true
+	}
+	return func(status int) bool {
+		return set[status]
+	}
+}
+
+// ThrottleFailures is a middleware that only counts the failures of a
+// client: a token is spent once next has answered with a status that
+// failed says is one, and the client is throttled with a 429 once its
+// bucket is empty, until it refills. Successful requests are free, and
+// don't even get a bucket.
+//
+// The requests of a client that has a token left all go through, so
+// concurrent ones can fail more often than the bucket holds; then it's
+// empty. WithBulkhead doesn't apply.
+func ThrottleFailures(next http.Handler, key KeyFunc, failed Failure, max uint, refill uint, d time.Duration, opts ...Option) http.Handler {
+	bs := newBuckets(max, refill, d, opts...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid, ok := key(r)
+		if !ok {
+			uid = r.RemoteAddr
+		}
+
+		res := bs.dryRun.check(bs.peek(uid))
+		if res.WouldThrottle {
+			log.Printf("dry run: would throttle %s, retry after %v", uid, res.RetryAfter)
+		}
+		if !res.Allowed {
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if failed(sw.status()) {
+			bs.take(uid)
+		}
+	})
+}
+
+// statusWriter records the status of the response it writes.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets handlers that stream their response flush it.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// status is the status of the response, 200 if next didn't write any.
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// KeyFunc derives the uid a request is throttled under. It reports false
+// when the request lacks what it looks at, so that another KeyFunc can
+// be tried instead (see FirstOf).
+type KeyFunc func(r *http.Request) (string, bool)
+
+// ClientIP keys a request on the IP address of its peer. Unlike
+// r.RemoteAddr, it doesn't include the client port, which changes with
+// every new connection. A RemoteAddr without a port is used as is.
+func ClientIP(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, r.RemoteAddr != ""
+	}
+	return host, true
+}
+
+// ForwardedFor keys a request on the client address reported by trusted
+// proxies, given as CIDRs (or bare IPs). The Forwarded header is used if
+// present, X-Forwarded-For otherwise, and walked from the nearest hop:
+// the first address that isn't a trusted proxy is the client. Requests that
+// don't come from a trusted proxy are keyed on their peer, as with ClientIP,
+// since anybody can send those headers.
+func ForwardedFor(trustedProxies ...string) (KeyFunc, error) {
+	var trusted []*net.IPNet
+	for _, p := range trustedProxies {
+		cidr := p
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+		}
+		trusted = append(trusted, n)
+	}
+
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) (string, bool) {
+		client, ok := ClientIP(r)
+		if !ok {
+			return "", false
+		}
+
+		hops := forwardedHops(r)
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(client)
+			if ip == nil || !isTrusted(ip) {
+				break
+			}
+
+			// client is a trusted proxy: believe what it says about its own client.
+			hop := hops[i]
+			if net.ParseIP(hop) == nil {
+				// "unknown", an obfuscated identifier or garbage:
+				// the trusted proxy is the best we know.
+				break
+			}
+			client = hop
+		}
+
+		return client, true
+	}, nil
+}
+
+// forwardedHops returns the addresses listed by the Forwarded header, or
+// else by X-Forwarded-For, from the original client to the nearest proxy.
+func forwardedHops(r *http.Request) []string {
+	var hops []string
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(k, "for") {
+					hops = append(hops, stripPort(strings.Trim(v, `"`)))
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, v := range strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			hops = append(hops, stripPort(v))
+		}
+	}
+	return hops
+}
+
+// stripPort turns "192.0.2.1:4711" into "192.0.2.1" and "[2001:db8::1]:4711"
+// or "[2001:db8::1]" into "2001:db8::1".
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// Header keys a request on the value of a request header, such as an API key.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		v := strings.TrimSpace(r.Header.Get(name))
+		return v, v != ""
+	}
+}
+
+// BearerSubject keys a request on the "sub" claim of the JWT in its
+// "Authorization: Bearer" header. The token is decoded, not verified:
+// only use it behind something that has checked the token, or clients
+// can pick any subject they like.
+func BearerSubject(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	return claims.Subject, claims.Subject != ""
+}
+
+// Composite keys a request on several sources at once, e.g. an API key
+// and the client IP. It reports false if any of them is missing, so that
+// FirstOf can fall back to a coarser key.
+func Composite(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			part, ok := key(r)
+			if !ok {
+				return "", false
+			}
+			parts[i] = part
+		}
+		return strings.Join(parts, "|"), len(parts) > 0
+	}
+}
+
+// FirstOf returns the key of the first KeyFunc that finds one. Ending
+// the list with ClientIP gives every request a key. Note that the keys of
+// all the KeyFuncs share the same buckets.
+func FirstOf(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, bool) {
+		for _, key := range keys {
+			if k, ok := key(r); ok {
+				return k, true
+			}
+		}
+		return "", false
+	}
+}
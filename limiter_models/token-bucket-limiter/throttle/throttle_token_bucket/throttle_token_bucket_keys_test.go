@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newKeyRequest(remoteAddr string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/hostname", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	return req
+}
+
+func jwt(payload string) string {
+	return "Bearer eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestClientIP(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		wantKey    string
+		wantOK     bool
+	}{
+		{desc: "IPv4 without the port", remoteAddr: "192.0.2.1:4711", wantKey: "192.0.2.1", wantOK: true},
+		{desc: "IPv6 without the port", remoteAddr: "[2001:db8::1]:4711", wantKey: "2001:db8::1", wantOK: true},
+		{desc: "no port, as is", remoteAddr: "192.0.2.1", wantKey: "192.0.2.1", wantOK: true},
+		{desc: "empty", remoteAddr: "", wantKey: "", wantOK: false},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			key, ok := ClientIP(newKeyRequest(test.remoteAddr, nil))
+			if key != test.wantKey || ok != test.wantOK {
+				t.Errorf("expected %q, %v; got %q, %v", test.wantKey, test.wantOK, key, ok)
+			}
+		})
+	}
+
+	// Two connections from the same client share a key.
+	a, _ := ClientIP(newKeyRequest("192.0.2.1:50000", nil))
+	b, _ := ClientIP(newKeyRequest("192.0.2.1:50001", nil))
+	if a != b {
+		t.Errorf("expected the same key for both ports; got %q and %q", a, b)
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	key, err := ForwardedFor("10.0.0.0/8", "2001:db8:cafe::17")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		headers    map[string]string
+		wantKey    string
+	}{
+		{
+			desc:       "untrusted peer, header ignored",
+			remoteAddr: "198.51.100.7:4711",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			wantKey:    "198.51.100.7",
+		},
+		{
+			desc:       "trusted peer, no header",
+			remoteAddr: "10.0.0.2:4711",
+			wantKey:    "10.0.0.2",
+		},
+		{
+			desc:       "trusted peer, X-Forwarded-For",
+			remoteAddr: "10.0.0.2:4711",
+			headers:    map[string]string{"X-Forwarded-For": "192.0.2.1"},
+			wantKey:    "192.0.2.1",
+		},
+		{
+			desc:       "chain of trusted proxies, spoofed first hop ignored",
+			remoteAddr: "10.0.0.2:4711",
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.9, 192.0.2.1, 10.0.0.3"},
+			wantKey:    "192.0.2.1",
+		},
+		{
+			desc:       "Forwarded is preferred",
+			remoteAddr: "[2001:db8:cafe::17]:4711",
+			headers: map[string]string{
+				"Forwarded":       `for="[2001:db8::60]:4711";proto=https, for=10.0.0.3`,
+				"X-Forwarded-For": "192.0.2.1",
+			},
+			wantKey: "2001:db8::60",
+		},
+		{
+			desc:       "obfuscated hop, trusted proxy kept",
+			remoteAddr: "10.0.0.2:4711",
+			headers:    map[string]string{"Forwarded": "for=_hidden, for=10.0.0.3"},
+			wantKey:    "10.0.0.3",
+		},
+		{
+			desc:       "only trusted hops",
+			remoteAddr: "10.0.0.2:4711",
+			headers:    map[string]string{"X-Forwarded-For": "10.0.0.4, 10.0.0.3"},
+			wantKey:    "10.0.0.4",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			got, ok := key(newKeyRequest(test.remoteAddr, test.headers))
+			if got != test.wantKey || !ok {
+				t.Errorf("expected %q, true; got %q, %v", test.wantKey, got, ok)
+			}
+		})
+	}
+
+	if _, err := ForwardedFor("not-a-cidr"); err == nil {
+		t.Error("expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	key := Header("X-Api-Key")
+
+	if got, ok := key(newKeyRequest("192.0.2.1:4711", map[string]string{"X-Api-Key": " k-123 "})); got != "k-123" || !ok {
+		t.Errorf("expected %q, true; got %q, %v", "k-123", got, ok)
+	}
+	if got, ok := key(newKeyRequest("192.0.2.1:4711", nil)); ok {
+		t.Errorf("expected no key without the header; got %q", got)
+	}
+}
+
+func TestBearerSubject(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		auth    string
+		wantKey string
+		wantOK  bool
+	}{
+		{desc: "subject", auth: jwt(`{"sub":"alice","iat":1661428800}`), wantKey: "alice", wantOK: true},
+		{desc: "lower case scheme", auth: "bearer" + jwt(`{"sub":"bob"}`)[len("Bearer"):], wantKey: "bob", wantOK: true},
+		{desc: "no subject", auth: jwt(`{"iat":1661428800}`)},
+		{desc: "not a JWT", auth: "Bearer opaque-token"},
+		{desc: "bad payload", auth: "Bearer a.!!!.c"},
+		{desc: "basic auth", auth: "Basic YWxpY2U6c2VjcmV0"},
+		{desc: "no header"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.auth != "" {
+				headers["Authorization"] = test.auth
+			}
+			got, ok := BearerSubject(newKeyRequest("192.0.2.1:4711", headers))
+			if got != test.wantKey || ok != test.wantOK {
+				t.Errorf("expected %q, %v; got %q, %v", test.wantKey, test.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestCompositeAndFirstOf(t *testing.T) {
+	key := FirstOf(
+		Composite(Header("X-Api-Key"), ClientIP),
+		BearerSubject,
+		ClientIP,
+	)
+
+	testCases := []struct {
+		desc    string
+		headers map[string]string
+		wantKey string
+	}{
+		{
+			desc:    "all the components of the composite",
+			headers: map[string]string{"X-Api-Key": "k-123", "Authorization": jwt(`{"sub":"alice"}`)},
+			wantKey: "k-123|192.0.2.1",
+		},
+		{
+			desc:    "missing component, falls back to the subject",
+			headers: map[string]string{"Authorization": jwt(`{"sub":"alice"}`)},
+			wantKey: "alice",
+		},
+		{
+			desc:    "nothing but the peer",
+			wantKey: "192.0.2.1",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			got, ok := key(newKeyRequest("192.0.2.1:4711", test.headers))
+			if got != test.wantKey || !ok {
+				t.Errorf("expected %q, true; got %q, %v", test.wantKey, got, ok)
+			}
+		})
+	}
+
+	if got, ok := Composite()(newKeyRequest("192.0.2.1:4711", nil)); ok {
+		t.Errorf("expected no key from an empty composite; got %q", got)
+	}
+	if got, ok := FirstOf(Header("X-Api-Key"))(newKeyRequest("192.0.2.1:4711", nil)); ok {
+		t.Errorf("expected no key when every KeyFunc misses; got %q", got)
+	}
+}
@@ -14,48 +14,116 @@
  * limitations under the License.
  */
 
- package main
-
- import (
-	 "context"
-	 "log"
-	 "net/http"
-	 "os"
-	 "time"
- 
-	 "github.com/gorilla/mux"
- )
- 
- var throttled = Throttle(getHostname, 1, 1, time.Second)
- 
- func getHostname(ctx context.Context) (string, error) {
-	 if ctx.Err() != nil {
-		 return "", ctx.Err()
-	 }
- 
-	 return os.Hostname()
- }
- 
- func throttledHandler(w http.ResponseWriter, r *http.Request) {
-	 ok, hostname, err := throttled(r.Context(), r.RemoteAddr)
- 
-	 if err != nil {
-		 http.Error(w, err.Error(), http.StatusInternalServerError)
-		 return
-	 }
- 
-	 if !ok {
-		 http.Error(w, "Too many requests", http.StatusTooManyRequests)
-		 return
-	 }
- 
-	 w.WriteHeader(http.StatusOK)
-	 w.Write([]byte(hostname))
- }
- 
- func main() {
-	 r := mux.NewRouter()
-	 r.HandleFunc("/hostname", throttledHandler)
-	 log.Fatal(http.ListenAndServe(":8080", r))
- }
- 
\ No newline at end of file
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// hostnameBulkhead caps the calls to getHostname in flight, across all clients.
+var hostnameBulkhead = NewBulkhead(64, 64, time.Second)
+
+func init() {
+	// The load of the bulkhead, on /debug/vars.
+	expvar.Publish("hostname_bulkhead", expvar.Func(func() any {
+		return bulkheadLoad(hostnameBulkhead)
+	}))
+}
+
+// load is what a Bulkhead is busy with.
+type load struct {
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+}
+
+func bulkheadLoad(b *Bulkhead) load {
+	return load{InFlight: b.InFlight(), Queued: b.Queued()}
+}
+
+// hostnameDryRun, once on, only logs the clients that would be throttled.
+var hostnameDryRun = NewDryRun(false)
+
+var throttled = Throttle(getHostname, 1, 1, time.Second, WithBulkhead(hostnameBulkhead), WithDryRun(hostnameDryRun))
+
+// clientKey picks the uid of a request. Swap in ForwardedFor behind a
+// reverse proxy, or FirstOf(BearerSubject, ClientIP) for per-user quotas.
+var clientKey KeyFunc = ClientIP
+
+func getHostname(ctx context.Context) (string, error) {
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+
+	return os.Hostname()
+}
+
+func throttledHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := clientKey(r)
+	if !ok {
+		uid = r.RemoteAddr
+	}
+
+	res, hostname, err := throttled(r.Context(), uid)
+
+	if res.WouldThrottle {
+		// Clients don't know about a limit that isn't enforced yet.
+		log.Printf("dry run: would throttle %s, retry after %v", uid, res.RetryAfter)
+	} else {
+		setRateLimitHeaders(w.Header(), res)
+	}
+
+	if errors.Is(err, ErrBulkheadFull) || errors.Is(err, ErrBulkheadTimeout) {
+		// Not the client's fault: getHostname is slow, so no Retry-After.
+		l := bulkheadLoad(hostnameBulkhead)
+		log.Printf("bulkhead: %v, %d in flight, %d queued", err, l.InFlight, l.Queued)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !res.Allowed {
+		w.Header().Set("Retry-After", seconds(res.RetryAfter))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(hostname))
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the IETF
+// "RateLimit header fields for HTTP" draft from res.
+func setRateLimitHeaders(h http.Header, res Result) {
+	h.Set("RateLimit-Limit", strconv.FormatUint(uint64(res.Limit), 10))
+	h.Set("RateLimit-Remaining", strconv.FormatUint(uint64(res.Remaining), 10))
+	h.Set("RateLimit-Reset", seconds(time.Until(res.ResetAt)))
+}
+
+// seconds rounds d up to whole seconds, as the headers expect.
+func seconds(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+}
+
+func main() {
+	r := mux.NewRouter()
+	r.HandleFunc("/hostname", throttledHandler)
+	r.Handle("/debug/vars", expvar.Handler())
+	log.Fatal(http.ListenAndServe(":8080", r))
+}
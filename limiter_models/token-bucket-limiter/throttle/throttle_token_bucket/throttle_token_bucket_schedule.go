@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Window is a range of the week with limits of its own, e.g. higher ones
+// overnight for batch partners, and lower ones during business hours.
+type Window struct {
+	// Days are the days the window starts on; none means every day.
+	Days []time.Weekday
+	// From and To are wall clock times, as offsets from midnight in the
+	// location of the Schedule: 9 * time.Hour is 9am. The window ends at
+	// To on the next day if To isn't after From, e.g. from 22h to 6h, and
+	// lasts all day if they are equal.
+	From, To time.Duration
+	// Max, Refill and D mean the same as the parameters of Throttle.
+	Max    uint
+	Refill uint
+	D      time.Duration
+}
+
+// Schedule picks the limits of the buckets by the time of day and the
+// day of the week. The first Window that contains the time applies; the
+// parameters of Throttle apply outside of them all.
+type Schedule struct {
+	loc     *time.Location
+	windows []Window
+}
+
+// NewSchedule returns a Schedule of windows, in the wall clock time of
+// loc: a window from 9h to 17h starts at 9am, in winter as in summer.
+// On the day clocks go forward, a time that doesn't exist is skipped;
+// on the day they go back, an hour that happens twice is in the window
+// both times.
+func NewSchedule(loc *time.Location, windows ...Window) (*Schedule, error) {
+	if loc == nil {
+		return nil, errors.New("no location")
+	}
+
+	for i, w := range windows {
+		switch {
+		case w.From < 0 || w.From >= 24*time.Hour || w.To < 0 || w.To >= 24*time.Hour:
+			return nil, fmt.Errorf("window %d: From and To must be within a day: %v, %v", i, w.From, w.To)
+		case w.Max < 1:
+			return nil, fmt.Errorf("window %d: Max must be at least 1", i)
+		case w.Refill < 1 || w.D <= 0:
+			return nil, fmt.Errorf("window %d: Refill and D must be positive: %d, %v", i, w.Refill, w.D)
+		}
+	}
+
+	return &Schedule{loc: loc, windows: windows}, nil
+}
+
+// WithSchedule changes the limits of the buckets as s says. A bucket
+// isn't reset when they change: it keeps the same share of its capacity,
+// e.g. half full before 10pm is half full after, however many tokens
+// that is. It is rescaled on its next call, and refills at its former
+// rate until then.
+func WithSchedule(s *Schedule) Option {
+	return func(bs *buckets) {
+		bs.schedule = s
+	}
+}
+
+// limits are the capacity and refill rate of a bucket.
+type limits struct {
+	max    uint
+	refill uint
+	d      time.Duration
+}
+
+// at returns the limits of the first window that contains t, if any.
+func (s *Schedule) at(t time.Time) (limits, bool) {
+	t = t.In(s.loc)
+	h, m, sec := t.Clock()
+	clock := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+
+	for _, w := range s.windows {
+		var in bool
+		switch {
+		case w.From < w.To:
+			in = w.on(day) && w.From <= clock && clock < w.To
+		case w.From > w.To:
+			in = w.on(day) && w.From <= clock || w.on(yesterday) && clock < w.To
+		default:
+			in = w.on(day)
+		}
+		if in {
+			return limits{max: w.Max, refill: w.Refill, d: w.D}, true
+		}
+	}
+	return limits{}, false
+}
+
+// on tells whether w starts on day.
+func (w Window) on(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// idle is the longest time a bucket of any of the windows takes to refill.
+func (s *Schedule) idle() time.Duration {
+	var idle time.Duration
+	for _, w := range s.windows {
+		if d := refillTime(w.Max, w.Refill, w.D); d > idle {
+			idle = d
+		}
+	}
+	return idle
+}
+
+// rescale carries b over from its former limits to l, at now: it is
+// refilled at its former rate, then keeps the same share of its capacity.
+func (b *bucket) rescale(l limits, now time.Time) {
+	b.refillTo(now)
+	if b.tokens == b.limits.max {
+		// A full bucket has nothing left to refill: its clock restarts.
+		b.time = now
+	}
+	b.tokens = b.tokens * l.max / b.limits.max
+	b.limits = l
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // for America/New_York, wherever the tests run
+)
+
+// batchSchedule has higher limits overnight, and lower ones during
+// business hours on weekdays, in New York.
+func batchSchedule(t *testing.T) *Schedule {
+	t.Helper()
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSchedule(loc,
+		Window{From: 22 * time.Hour, To: 6 * time.Hour, Max: 20, Refill: 1, D: 24 * time.Hour},
+		Window{
+			Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+			From: 9 * time.Hour, To: 17 * time.Hour, Max: 4, Refill: 1, D: 24 * time.Hour,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestScheduleAt(t *testing.T) {
+	s := batchSchedule(t)
+	night := limits{max: 20, refill: 1, d: 24 * time.Hour}
+	office := limits{max: 4, refill: 1, d: 24 * time.Hour}
+
+	tests := []struct {
+		time string // in New York
+		want limits
+		ok   bool
+	}{
+		{time: "2022-08-24T21:59:59-04:00"},
+		{time: "2022-08-24T22:00:00-04:00", want: night, ok: true},
+		{time: "2022-08-25T05:59:59-04:00", want: night, ok: true},
+		{time: "2022-08-25T06:00:00-04:00"},
+		{time: "2022-08-25T09:00:00-04:00", want: office, ok: true},
+		{time: "2022-08-25T16:59:59-04:00", want: office, ok: true},
+		{time: "2022-08-25T17:00:00-04:00"},
+		// Not on weekends.
+		{time: "2022-08-27T12:00:00-04:00"},
+		// Clocks go forward at 2am on March 13th, in the night window.
+		{time: "2022-03-13T01:59:59-05:00", want: night, ok: true},
+		{time: "2022-03-13T03:00:00-04:00", want: night, ok: true},
+		{time: "2022-03-13T06:00:00-04:00"},
+		// Clocks go back at 2am on November 6th: 1:30am happens twice.
+		{time: "2022-11-06T01:30:00-04:00", want: night, ok: true},
+		{time: "2022-11-06T01:30:00-05:00", want: night, ok: true},
+		{time: "2022-11-06T06:00:00-05:00"},
+		// The office window follows the wall clock, in winter as in summer.
+		{time: "2022-11-07T08:59:59-05:00"},
+		{time: "2022-11-07T09:00:00-05:00", want: office, ok: true},
+	}
+
+	for _, tt := range tests {
+		at, err := time.Parse(time.RFC3339, tt.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The time zone of the argument doesn't matter, only the instant.
+		got, ok := s.at(at.UTC())
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: expected %+v, %v; got %+v, %v", tt.time, tt.want, tt.ok, got, ok)
+		}
+	}
+}
+
+func TestNewScheduleErrors(t *testing.T) {
+	tests := []struct {
+		window Window
+		want   string
+	}{
+		{
+			window: Window{From: 22 * time.Hour, To: 24 * time.Hour, Max: 1, Refill: 1, D: time.Second},
+			want:   "window 0: From and To must be within a day: 22h0m0s, 24h0m0s",
+		},
+		{
+			window: Window{From: 9 * time.Hour, To: 17 * time.Hour, Refill: 1, D: time.Second},
+			want:   "window 0: Max must be at least 1",
+		},
+		{
+			window: Window{From: 9 * time.Hour, To: 17 * time.Hour, Max: 1, Refill: 1},
+			want:   "window 0: Refill and D must be positive: 1, 0s",
+		},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewSchedule(time.UTC, tt.window); err == nil || err.Error() != tt.want {
+			t.Errorf("expected %q; got %v", tt.want, err)
+		}
+	}
+
+	if _, err := NewSchedule(nil); err == nil {
+		t.Error("expected an error without a location")
+	}
+}
+
+// TestBucketRescale tests that a bucket is refilled at its former rate,
+// then keeps the same share of its capacity.
+func TestBucketRescale(t *testing.T) {
+	start := time.Date(2022, time.August, 25, 12, 0, 0, 0, time.UTC)
+	before := limits{max: 4, refill: 1, d: time.Second}
+	after := limits{max: 8, refill: 2, d: time.Second}
+
+	tests := []struct {
+		desc     string
+		tokens   uint
+		want     uint
+		wantTime time.Time
+	}{
+		{desc: "partial refill", tokens: 1, want: 6, wantTime: start.Add(2 * time.Second)},
+		{desc: "refilled to capacity", tokens: 2, want: 8, wantTime: start.Add(2500 * time.Millisecond)},
+		{desc: "refilled past capacity", tokens: 3, want: 8, wantTime: start.Add(2500 * time.Millisecond)},
+	}
+
+	for _, tt := range tests {
+		b := &bucket{tokens: tt.tokens, time: start, limits: before}
+		b.rescale(after, start.Add(2500*time.Millisecond))
+		if b.tokens != tt.want || !b.time.Equal(tt.wantTime) || b.limits != after {
+			t.Errorf("%s: expected %d tokens at %v; got %d at %v, with %+v", tt.desc, tt.want, tt.wantTime, b.tokens, b.time, b.limits)
+		}
+	}
+}
+
+// TestBucketsScheduleRescale follows a bucket into the night window that
+// starts at 10pm on the Saturday clocks go back, at 2am, and so lasts nine
+// hours rather than eight.
+func TestBucketsScheduleRescale(t *testing.T) {
+	// 9pm in New York, on the Saturday before clocks go back.
+	clock := &fakeClock{now: time.Date(2022, time.November, 6, 1, 0, 0, 0, time.UTC)}
+	bs := newBuckets(10, 1, 24*time.Hour, WithSchedule(batchSchedule(t)), withClock(clock.Now))
+
+	for i := 0; i < 5; i++ {
+		bs.take("a")
+	}
+	if r := bs.take("a"); r.Limit != 10 || r.Remaining != 4 {
+		t.Errorf("before 10pm: expected 4 of 10 tokens left; got %d of %d", r.Remaining, r.Limit)
+	}
+
+	// The bucket keeps its share of the capacity: 4 of 10 is 8 of 20.
+	clock.Advance(time.Hour)
+	if r := bs.take("a"); r.Limit != 20 || r.Remaining != 7 {
+		t.Errorf("at 10pm: expected 7 of 20 tokens left; got %d of %d", r.Remaining, r.Limit)
+	}
+
+	// 5:59am is 8 hours later by the wall clock, but 9 in fact.
+	clock.Advance(8*time.Hour + 59*time.Minute)
+	if r := bs.take("a"); r.Limit != 20 || r.Remaining != 6 {
+		t.Errorf("at 5:59am: expected 6 of 20 tokens left; got %d of %d", r.Remaining, r.Limit)
+	}
+
+	// 6 of 20 is 3 of 10.
+	clock.Advance(time.Minute)
+	if r := bs.take("a"); r.Limit != 10 || r.Remaining != 2 {
+		t.Errorf("at 6am: expected 2 of 10 tokens left; got %d of %d", r.Remaining, r.Limit)
+	}
+
+	// A new bucket starts full, with the limits of the time.
+	if r := bs.take("b"); r.Limit != 10 || r.Remaining != 9 {
+		t.Errorf("new bucket: expected 9 of 10 tokens left; got %d of %d", r.Remaining, r.Limit)
+	}
+
+	if want := 24 * 20 * time.Hour; bs.idle != want {
+		t.Errorf("expected an idle timeout of %v; got %v", want, bs.idle)
+	}
+}
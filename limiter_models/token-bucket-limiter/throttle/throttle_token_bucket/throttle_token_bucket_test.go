@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a time source that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, time.August, 25, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestThrottleParallelCallers tests whether concurrent callers sharing
+// uids get exactly max calls per uid. Run it with -race.
+func TestThrottleParallelCallers(t *testing.T) {
+	const max, uids, callersPerUID, callsPerCaller = 100, 8, 20, 10
+
+	var calls int64
+	effector := func(ctx context.Context) (string, error) {
+		atomic.AddInt64(&calls, 1)
+		return "", nil
+	}
+	throttled := Throttle(effector, max, 1, time.Hour)
+
+	allowed := make([]int64, uids)
+	var wg sync.WaitGroup
+	for u := 0; u < uids; u++ {
+		for c := 0; c < callersPerUID; c++ {
+			wg.Add(1)
+			go func(u int) {
+				defer wg.Done()
+				for i := 0; i < callsPerCaller; i++ {
+					res, _, err := throttled(context.Background(), fmt.Sprintf("uid-%d", u))
+					if err != nil {
+						t.Error("unexpected error:", err)
+					}
+					if res.Allowed {
+						atomic.AddInt64(&allowed[u], 1)
+					}
+				}
+			}(u)
+		}
+	}
+	wg.Wait()
+
+	for u, n := range allowed {
+		if n != max {
+			t.Errorf("uid-%d: expected %d allowed calls; got %d", u, max, n)
+		}
+	}
+	if calls != max*uids {
+		t.Errorf("expected %d effector calls; got %d", max*uids, calls)
+	}
+}
+
+// TestThrottleParallelEviction tests whether eviction under a small cap is
+// safe while many uids are throttled at once. Run it with -race.
+func TestThrottleParallelEviction(t *testing.T) {
+	bs := newBuckets(1, 1, time.Second, WithMaxUIDs(16))
+
+	var wg sync.WaitGroup
+	for c := 0; c < 32; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				bs.take(fmt.Sprintf("uid-%d-%d", c, i%40))
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if n := bs.len(); n > 16 {
+		t.Errorf("expected at most 16 buckets; got %d", n)
+	}
+}
+
+// TestBucketsIdleTimeout tests whether buckets unused for the idle timeout are dropped.
+func TestBucketsIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	bs := newBuckets(1, 1, time.Second, WithIdleTimeout(time.Minute), withClock(clock.Now))
+
+	bs.take("a")
+	clock.Advance(30 * time.Second)
+	bs.take("b")
+	clock.Advance(45 * time.Second)
+	bs.take("c")
+
+	if n := bs.len(); n != 2 {
+		t.Errorf("expected a to be dropped, leaving 2 buckets; got %d", n)
+	}
+}
+
+// TestBucketsDefaultIdleTimeout tests whether a bucket is kept until it
+// would have refilled, so that dropping it doesn't hand out extra tokens.
+func TestBucketsDefaultIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	bs := newBuckets(3, 1, time.Second, withClock(clock.Now))
+
+	for i := 0; i < 3; i++ {
+		bs.take("a")
+	}
+	if bs.take("a").Allowed {
+		t.Fatal("expected a to be empty")
+	}
+
+	clock.Advance(2 * time.Second)
+	bs.take("b")
+	if n := bs.len(); n != 2 {
+		t.Fatalf("expected a to be kept while refilling; got %d buckets", n)
+	}
+
+	clock.Advance(3 * time.Second)
+	bs.take("c")
+	if n := bs.len(); n != 1 {
+		t.Errorf("expected a and b to be dropped once full; got %d buckets", n)
+	}
+
+	for i := 0; i < 3; i++ {
+		if !bs.take("a").Allowed {
+			t.Errorf("call %d: expected a new, full bucket for a", i+1)
+		}
+	}
+}
+
+// TestBucketsMaxUIDs tests whether the least recently used bucket makes
+// room for a new uid once the cap is reached.
+func TestBucketsMaxUIDs(t *testing.T) {
+	clock := newFakeClock()
+	bs := newBuckets(1, 1, time.Hour, WithMaxUIDs(2), withClock(clock.Now))
+
+	bs.take("a")
+	bs.take("b")
+	bs.take("a") // a is now the most recently used
+	bs.take("c") // b has to go
+
+	if n := bs.len(); n != 2 {
+		t.Fatalf("expected 2 buckets; got %d", n)
+	}
+	if bs.take("a").Allowed {
+		t.Error("expected a to be kept, and empty")
+	}
+	if !bs.take("b").Allowed {
+		t.Error("expected b to be dropped, and start over")
+	}
+}
+
+// TestBucketsResult tests the remaining tokens, reset time and retry delay
+// reported along with each call.
+func TestBucketsResult(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	bs := newBuckets(4, 2, time.Second, withClock(clock.Now))
+
+	want := []Result{
+		{Allowed: true, Limit: 4, Remaining: 3, ResetAt: start.Add(time.Second)},
+		{Allowed: true, Limit: 4, Remaining: 2, ResetAt: start.Add(time.Second)},
+		{Allowed: true, Limit: 4, Remaining: 1, ResetAt: start.Add(2 * time.Second)},
+		{Allowed: true, Limit: 4, Remaining: 0, ResetAt: start.Add(2 * time.Second)},
+		{Allowed: false, Limit: 4, Remaining: 0, ResetAt: start.Add(2 * time.Second), RetryAfter: 750 * time.Millisecond},
+	}
+	for i, w := range want {
+		if i == len(want)-1 {
+			clock.Advance(250 * time.Millisecond)
+		}
+		if got := bs.take("a"); got != w {
+			t.Errorf("call %d: expected %+v; got %+v", i+1, w, got)
+		}
+	}
+
+	// One refill later, two tokens are back.
+	clock.Advance(750 * time.Millisecond)
+	w := Result{Allowed: true, Limit: 4, Remaining: 1, ResetAt: start.Add(3 * time.Second)}
+	if got := bs.take("a"); got != w {
+		t.Errorf("expected %+v; got %+v", w, got)
+	}
+}
+
+// TestBucketsRefill tests how take refills a bucket: by whole refills
+// only, and restarting its clock once it is past capacity.
+func TestBucketsRefill(t *testing.T) {
+	clock := newFakeClock()
+	bs := newBuckets(3, 1, time.Second, WithIdleTimeout(time.Hour), withClock(clock.Now))
+	bucketTime := func() time.Time { return bs.m["a"].Value.(*bucket).time }
+
+	bs.take("a")
+
+	// Refilled past capacity: full, less the token taken, from now on.
+	clock.Advance(10 * time.Second)
+	restart := clock.Now()
+	if got, w := bs.take("a"), (Result{Allowed: true, Limit: 3, Remaining: 2, ResetAt: restart.Add(time.Second)}); got != w {
+		t.Errorf("past capacity: expected %+v; got %+v", w, got)
+	}
+	if got := bucketTime(); !got.Equal(restart) {
+		t.Errorf("past capacity: expected the clock to restart at %v; got %v", restart, got)
+	}
+	bs.take("a")
+	bs.take("a")
+
+	// One refill and a half: the half is kept for later.
+	clock.Advance(1500 * time.Millisecond)
+	if got, w := bs.take("a"), (Result{Allowed: true, Limit: 3, Remaining: 0, ResetAt: restart.Add(4 * time.Second)}); got != w {
+		t.Errorf("partial refill: expected %+v; got %+v", w, got)
+	}
+	if got := bucketTime(); !got.Equal(restart.Add(time.Second)) {
+		t.Errorf("partial refill: expected the clock at %v; got %v", restart.Add(time.Second), got)
+	}
+
+	// A throttled call leaves the bucket as it is.
+	if got, w := bs.take("a"), (Result{Limit: 3, ResetAt: restart.Add(4 * time.Second), RetryAfter: 500 * time.Millisecond}); got != w {
+		t.Errorf("throttled: expected %+v; got %+v", w, got)
+	}
+
+	// Refilled up to capacity exactly: the clock keeps counting.
+	clock.Advance(3 * time.Second)
+	if got, w := bs.take("a"), (Result{Allowed: true, Limit: 3, Remaining: 2, ResetAt: restart.Add(5 * time.Second)}); got != w {
+		t.Errorf("at capacity: expected %+v; got %+v", w, got)
+	}
+}
+
+// TestThrottledHandlerHeaders tests the rate limit headers of the mainline handler.
+func TestThrottledHandlerHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/hostname", nil)
+	req.RemoteAddr = "192.0.2.31:4321"
+
+	rec := httptest.NewRecorder()
+	throttledHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected %d; got %d", http.StatusOK, rec.Code)
+	}
+	for header, want := range map[string]string{
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "1",
+		"Retry-After":         "",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s: expected %q; got %q", header, want, got)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	throttledHandler(rec, req)
+
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d; got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	for header, want := range map[string]string{
+		"RateLimit-Limit":     "1",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "1",
+		"Retry-After":         "1",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s: expected %q; got %q", header, want, got)
+		}
+	}
+}
+
+// TestThrottledHandlerBulkheadLoad tests whether the load of the bulkhead
+// is published while calls are blocked, and logged when it is full.
+func TestThrottledHandlerBulkheadLoad(t *testing.T) {
+	defer func(saved Throttled[string]) { throttled = saved }(throttled)
+	defer func(saved *Bulkhead) { hostnameBulkhead = saved }(hostnameBulkhead)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	release := make(chan struct{})
+	hostnameBulkhead = NewBulkhead(1, 1, time.Second)
+	throttled = Throttle(func(ctx context.Context) (string, error) {
+		<-release
+		return "host", nil
+	}, 10, 1, time.Second, WithBulkhead(hostnameBulkhead))
+
+	var wg sync.WaitGroup
+	for i, remoteAddr := range []string{"192.0.2.40:4321", "192.0.2.41:4321"} {
+		wg.Add(1)
+		go func(remoteAddr string) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/hostname", nil)
+			req.RemoteAddr = remoteAddr
+			throttledHandler(httptest.NewRecorder(), req)
+		}(remoteAddr)
+		waitFor(t, "the calls to block", func() bool { return hostnameBulkhead.InFlight()+hostnameBulkhead.Queued() == i+1 })
+	}
+
+	if got, want := expvar.Get("hostname_bulkhead").String(), `{"in_flight":1,"queued":1}`; got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hostname", nil)
+	req.RemoteAddr = "192.0.2.42:4321"
+	rec := httptest.NewRecorder()
+	throttledHandler(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d; got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if !strings.Contains(logged.String(), "1 in flight, 1 queued") {
+		t.Errorf("expected the load to be logged; got %q", logged.String())
+	}
+
+	close(release)
+	wg.Wait()
+	if got, want := expvar.Get("hostname_bulkhead").String(), `{"in_flight":0,"queued":0}`; got != want {
+		t.Errorf("expected %s; got %s", want, got)
+	}
+}
+
+// waitFor polls cond until it is true, or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+	}
+}
+
+// TestThrottleBulkhead tests whether calls beyond the bulkhead's limit are
+// queued, then rejected apart from throttled calls.
+func TestThrottleBulkhead(t *testing.T) {
+	release := make(chan struct{})
+	bulkhead := NewBulkhead(1, 1, 50*time.Millisecond)
+	throttle := ThrottleErr(func(ctx context.Context) error {
+		<-release
+		return nil
+	}, 10, 1, time.Second, WithBulkhead(bulkhead))
+
+	ctx := context.Background()
+	first := make(chan error)
+	go func() {
+		_, err := throttle(ctx, "a")
+		first <- err
+	}()
+	waitFor(t, "the first call to run", func() bool { return bulkhead.InFlight() == 1 })
+
+	queued := make(chan error)
+	go func() {
+		_, err := throttle(ctx, "b")
+		queued <- err
+	}()
+	waitFor(t, "the second call to queue", func() bool { return bulkhead.Queued() == 1 })
+
+	r, err := throttle(ctx, "c")
+	if !r.Allowed || !errors.Is(err, ErrBulkheadFull) {
+		t.Errorf("expected an allowed call failing with ErrBulkheadFull; got %v, %v", r.Allowed, err)
+	}
+
+	if err := <-queued; !errors.Is(err, ErrBulkheadTimeout) {
+		t.Error("expected ErrBulkheadTimeout; got", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Error("unexpected error:", err)
+	}
+	if n := bulkhead.InFlight(); n != 0 {
+		t.Error("expected 0 in flight; got", n)
+	}
+
+	if r, err := throttle(ctx, "d"); !r.Allowed || err != nil {
+		t.Errorf("expected an allowed call; got %v, %v", r.Allowed, err)
+	}
+}
+
+// TestThrottledHandlerBulkheadFull tests whether the mainline handler tells
+// a full bulkhead apart from a throttled client.
+func TestThrottledHandlerBulkheadFull(t *testing.T) {
+	defer func(saved Throttled[string]) { throttled = saved }(throttled)
+	defer func(saved *Bulkhead) { hostnameBulkhead = saved }(hostnameBulkhead)
+	hostnameBulkhead = NewBulkhead(0, 0, 0)
+	throttled = Throttle(getHostname, 1, 1, time.Second, WithBulkhead(hostnameBulkhead))
+
+	req := httptest.NewRequest(http.MethodGet, "/hostname", nil)
+	req.RemoteAddr = "192.0.2.33:4321"
+
+	rec := httptest.NewRecorder()
+	throttledHandler(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d; got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("expected no Retry-After; got %q", got)
+	}
+}
+
+// TestThrottleDryRun tests whether a DryRun lets throttled calls through
+// while it is on, and counts them, without changing the accounting.
+func TestThrottleDryRun(t *testing.T) {
+	clock := newFakeClock()
+	dryRun := NewDryRun(true)
+	calls := 0
+	throttle := ThrottleErr(func(ctx context.Context) error {
+		calls++
+		return nil
+	}, 1, 1, time.Second, WithDryRun(dryRun), withClock(clock.Now))
+
+	ctx := context.Background()
+	for i, wouldThrottle := range []bool{false, true, true} {
+		r, err := throttle(ctx, "a")
+		if !r.Allowed || r.WouldThrottle != wouldThrottle || err != nil {
+			t.Errorf("call %d: expected an allowed call, WouldThrottle %v; got %+v, %v", i+1, wouldThrottle, r, err)
+		}
+	}
+	if calls != 3 {
+		t.Error("expected 3 calls; got", calls)
+	}
+	if n := dryRun.WouldThrottle(); n != 2 {
+		t.Error("expected 2 calls that would be throttled; got", n)
+	}
+
+	// Switched off, the same bucket throttles again.
+	dryRun.Set(false)
+	if r, _ := throttle(ctx, "a"); r.Allowed || r.WouldThrottle {
+		t.Errorf("expected a throttled call; got %+v", r)
+	}
+
+	clock.Advance(time.Second)
+	if r, _ := throttle(ctx, "a"); !r.Allowed || r.WouldThrottle {
+		t.Errorf("expected an allowed call; got %+v", r)
+	}
+	if calls != 4 {
+		t.Error("expected 4 calls; got", calls)
+	}
+}
+
+// TestThrottleFailures tests whether only the failed requests of a
+// client are counted, and whether it is throttled once they pile up.
+func TestThrottleFailures(t *testing.T) {
+	clock := newFakeClock()
+	calls := 0
+	login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "secret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("welcome"))
+	})
+	h := ThrottleFailures(login, ClientIP, StatusIn(http.StatusUnauthorized, http.StatusForbidden),
+		3, 1, time.Minute, withClock(clock.Now))
+
+	serve := func(addr, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("Authorization", password)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 10; i++ {
+		if rec := serve("192.0.2.40:1234", "secret"); rec.Code != http.StatusOK {
+			t.Fatalf("success %d: expected %d; got %d", i+1, http.StatusOK, rec.Code)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if rec := serve("192.0.2.40:1234", "guess"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected %d; got %d", i+1, http.StatusUnauthorized, rec.Code)
+		}
+	}
+
+	// Three failures in, even the right password is turned away.
+	rec := serve("192.0.2.40:1234", "secret")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d; got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60; got %q", got)
+	}
+	if calls != 13 {
+		t.Errorf("expected 13 calls; got %d", calls)
+	}
+
+	// Another client isn't.
+	if rec := serve("192.0.2.41:1234", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("another client: expected %d; got %d", http.StatusOK, rec.Code)
+	}
+
+	// A minute later, the client gets one more try.
+	clock.Advance(time.Minute)
+	if rec := serve("192.0.2.40:1234", "guess"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d; got %d", http.StatusUnauthorized, rec.Code)
+	}
+	if rec := serve("192.0.2.40:1234", "secret"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected %d; got %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
+
+// TestThrottleFailuresDryRun tests whether a DryRun lets a client with
+// too many failures through.
+func TestThrottleFailuresDryRun(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	dryRun := NewDryRun(true)
+	forbidden := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	h := ThrottleFailures(forbidden, ClientIP, StatusIn(http.StatusForbidden), 1, 1, time.Minute,
+		WithDryRun(dryRun), withClock(newFakeClock().Now))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("request %d: expected %d; got %d", i+1, http.StatusForbidden, rec.Code)
+		}
+	}
+	if n := dryRun.WouldThrottle(); n != 2 {
+		t.Error("expected 2 requests that would be throttled; got", n)
+	}
+	if n := strings.Count(logged.String(), "dry run: would throttle 192.0.2.1, retry after 1m0s"); n != 2 {
+		t.Errorf("expected 2 requests logged as would be throttled; got %q", logged.String())
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		desc    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{
+			desc:    "nothing written",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			want:    http.StatusOK,
+		},
+		{
+			desc:    "body only",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) },
+			want:    http.StatusOK,
+		},
+		{
+			desc: "first status wins",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				w.WriteHeader(http.StatusOK)
+			},
+			want: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+		tt.handler(sw, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := sw.status(); got != tt.want {
+			t.Errorf("%s: expected %d; got %d", tt.desc, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package ratelimiter
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit is what a bucket is made of: it holds up to Burst tokens, and gets Rate tokens back per second.
+// A bucket that has not been used for TTL is forgotten; the next request for its source starts a full one.
+type Limit struct {
+	Rate  rate.Limit
+	Burst int64
+	TTL   time.Duration
+}
+
+// Reservation is the outcome of BucketStore.Reserve for one bucket.
+type Reservation struct {
+	// OK is true if the bucket had the tokens.
+	// They were taken only if all the buckets of the request had theirs.
+	OK bool
+	// Delay is how long the request has to wait before it may proceed,
+	// or, when the reservation is not OK, how long it would have had to.
+	// It is rate.InfDuration when the bucket never gets the tokens back.
+	Delay time.Duration
+	// Tokens is what is left in the bucket, negative when tokens are owed to reservations that are still waiting.
+	// Unless the tokens were taken, it is what the bucket holds at the time of the reservation.
+	Tokens float64
+}
+
+// BucketStore keeps the token buckets of a rate limiter, keyed by source; a source has a bucket per Limit.
+// Reserve must check and update the buckets of a source atomically: when the replicas of a service share a store,
+// they must not hand out the same tokens twice, or clients get N times the configured Average again.
+type BucketStore interface {
+	// Reserve takes amount tokens from each of the buckets of key at now, if they all have them within maxDelay,
+	// and returns a Reservation per limit.
+	// A negative amount gives tokens back, up to the burst:
+	// that is how a request that stops waiting returns its reservation.
+	Reserve(ctx context.Context, key string, limits []Limit, amount int64, now time.Time, maxDelay time.Duration) ([]Reservation, error)
+}
+
+// take is the token bucket arithmetic of rate.Limiter.ReserveN, shared by all the stores:
+// it takes amount tokens from a bucket that held tokens at last.
+// When the Reservation is OK, the bucket is to be updated to Reservation.Tokens at now;
+// otherwise it is left as is.
+func take(tokens float64, last time.Time, limit Limit, amount int64, now time.Time, maxDelay time.Duration) Reservation {
+	tokens = refilled(tokens, last, limit, now)
+	tokens -= float64(amount)
+	if tokens > float64(limit.Burst) {
+		tokens = float64(limit.Burst)
+	}
+
+	var delay time.Duration
+	if tokens < 0 {
+		if limit.Rate > 0 {
+			delay = time.Duration(-tokens / float64(limit.Rate) * float64(time.Second))
+		} else {
+			delay = rate.InfDuration
+		}
+	}
+
+	// Tokens given back are always taken back in, however many reservations are still waiting.
+	if amount > 0 && (amount > limit.Burst || delay > maxDelay) {
+		return Reservation{Delay: delay, Tokens: tokens + float64(amount)}
+	}
+	return Reservation{OK: true, Delay: delay, Tokens: tokens}
+}
+
+// refilled returns what a bucket that held tokens at last holds at now.
+func refilled(tokens float64, last time.Time, limit Limit, now time.Time) float64 {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*float64(limit.Rate))
+	}
+	return tokens
+}
+
+// bucketState is a bucket of the memoryStore.
+type bucketState struct {
+	tokens float64
+	last   time.Time
+}
+
+// Overflow decides what happens to the requests of a new source when the memory store is full,
+// e.g. during a flood of requests from spoofed IPs.
+type Overflow int
+
+const (
+	// OverflowEvict forgets the buckets of the least recently seen source to make room.
+	// It is the default. Under a flood, legitimate clients may then get a full bucket again.
+	OverflowEvict Overflow = iota
+	// OverflowShared gives the new sources a single bucket to share, per route, until some room frees up.
+	// The sources already known keep their own.
+	OverflowShared
+	// OverflowReject rejects the requests of the new sources with a 429 until some room frees up.
+	OverflowReject
+)
+
+// sourceEntry holds the buckets of a source in the memoryStore.
+type sourceEntry struct {
+	key     string
+	states  []bucketState // one per limit.
+	expires time.Time
+}
+
+// memoryStore keeps the buckets of a single traefik instance. It is the default BucketStore.
+// It keeps those of up to capacity sources, which it forgets once they have not been seen for the ttl of their limits.
+type memoryStore struct {
+	mu       sync.Mutex
+	capacity int
+	overflow Overflow
+	sources  map[string]*list.Element // of *sourceEntry, keyed by source.
+	lru      *list.List               // of the sources, from the most recently seen.
+	// shared are the buckets of the overflow, with OverflowShared, keyed by limits:
+	// the routes, which have limits of their own, do not share them.
+	shared map[string]*sourceEntry
+}
+
+func newMemoryStore(capacity int, overflow Overflow) (*memoryStore, error) {
+	if capacity < 1 {
+		return nil, fmt.Errorf("capacity must be positive: %d", capacity)
+	}
+	switch overflow {
+	case OverflowEvict, OverflowShared, OverflowReject:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy: %d", overflow)
+	}
+
+	return &memoryStore{
+		capacity: capacity,
+		overflow: overflow,
+		sources:  make(map[string]*list.Element),
+		lru:      list.New(),
+		shared:   make(map[string]*sourceEntry),
+	}, nil
+}
+
+// Len returns the number of sources with buckets.
+func (s *memoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forgetExpired(time.Now())
+	return len(s.sources)
+}
+
+func (s *memoryStore) Reserve(_ context.Context, key string, limits []Limit, amount int64, now time.Time, maxDelay time.Duration) ([]Reservation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ttl time.Duration
+	for _, limit := range limits {
+		if limit.TTL > ttl {
+			ttl = limit.TTL
+		}
+	}
+
+	var entry *sourceEntry
+	if elem, found := s.sources[key]; found {
+		if now.Before(elem.Value.(*sourceEntry).expires) {
+			entry = elem.Value.(*sourceEntry)
+			s.lru.MoveToFront(elem)
+		} else {
+			s.forget(elem)
+		}
+	}
+
+	if entry == nil {
+		// With limits of different ttls, such as those of routes, the sources do not expire in the order they were seen:
+		// one may outlive its ttl until it is the least recently seen.
+		s.forgetExpired(now)
+
+		if len(s.sources) >= s.capacity {
+			switch s.overflow {
+			case OverflowShared:
+				sharedKey := fmt.Sprint(limits)
+				entry = s.shared[sharedKey]
+				if entry == nil || !now.Before(entry.expires) {
+					entry = &sourceEntry{}
+					s.shared[sharedKey] = entry
+				}
+			case OverflowReject:
+				return s.rejectAll(limits, now), nil
+			default:
+				s.forget(s.lru.Back())
+			}
+		}
+
+		if entry == nil {
+			entry = &sourceEntry{key: key}
+			s.sources[key] = s.lru.PushFront(entry)
+		}
+	}
+
+	states := entry.states
+	if len(states) != len(limits) {
+		states = make([]bucketState, len(limits))
+		for i, limit := range limits {
+			states[i] = bucketState{tokens: float64(limit.Burst), last: now}
+		}
+	}
+
+	reservations := make([]Reservation, len(limits))
+	ok := true
+	for i, limit := range limits {
+		reservations[i] = take(states[i].tokens, states[i].last, limit, amount, now, maxDelay)
+		ok = ok && reservations[i].OK
+	}
+
+	if ok {
+		for i, res := range reservations {
+			states[i] = bucketState{tokens: res.Tokens, last: now}
+		}
+	} else {
+		for i := range reservations {
+			reservations[i].Tokens = refilled(states[i].tokens, states[i].last, limits[i], now)
+		}
+	}
+
+	// We update the expiry time even when the tokens were not taken,
+	// as it is supposed to reflect the activity (or lack thereof) on that source.
+	entry.states = states
+	entry.expires = now.Add(ttl)
+
+	return reservations, nil
+}
+
+// rejectAll returns the reservations of a source that does not fit in the store:
+// its requests are to be retried once the least recently seen source is forgotten.
+func (s *memoryStore) rejectAll(limits []Limit, now time.Time) []Reservation {
+	delay := s.lru.Back().Value.(*sourceEntry).expires.Sub(now)
+
+	reservations := make([]Reservation, len(limits))
+	for i := range reservations {
+		reservations[i] = Reservation{Delay: delay}
+	}
+	return reservations
+}
+
+// forgetExpired forgets the sources that have not been seen for their ttl, from the least recently seen.
+func (s *memoryStore) forgetExpired(now time.Time) {
+	for elem := s.lru.Back(); elem != nil && !now.Before(elem.Value.(*sourceEntry).expires); elem = s.lru.Back() {
+		s.forget(elem)
+	}
+}
+
+func (s *memoryStore) forget(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.sources, elem.Value.(*sourceEntry).key)
+}
@@ -0,0 +1,828 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ptypes "github.com/traefik/paerser/types"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+	lua "github.com/yuin/gopher-lua"
+	"golang.org/x/time/rate"
+)
+
+// fakeRedis is an in-process stand-in for Redis. It speaks RESP and runs a single script,
+// reserveScript, in a Lua 5.1 interpreter like Redis does: one call at a time,
+// with the few commands the script calls.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	lua      *lua.LState
+	hashes   map[string]map[string]string
+	expires  map[string]time.Time
+	scripts  map[string]bool // loaded, by SHA1.
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	f := &fakeRedis{
+		ln:      ln,
+		lua:     lua.NewState(),
+		hashes:  map[string]map[string]string{},
+		expires: map[string]time.Time{},
+		scripts: map[string]bool{},
+	}
+	redis := f.lua.NewTable()
+	redis.RawSetString("call", f.lua.NewFunction(f.call))
+	f.lua.SetGlobal("redis", redis)
+	t.Cleanup(func() {
+		_ = ln.Close()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.lua.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readReply(r)
+		if err != nil {
+			return
+		}
+
+		values, _ := req.([]interface{})
+		args := make([]string, len(values))
+		for i, v := range values {
+			args[i], _ = v.(string)
+		}
+
+		if _, err := io.WriteString(conn, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+// exec runs a command and returns its RESP reply.
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	f.commands = append(f.commands, args[0])
+
+	switch args[0] {
+	case "EVAL":
+		if len(args) < 2 {
+			return "-ERR wrong number of arguments for 'eval' command\r\n"
+		}
+		sum := sha1.Sum([]byte(args[1]))
+		sha := hex.EncodeToString(sum[:])
+		if sha != reserveScriptSHA {
+			return "-ERR this stand-in only runs reserveScript\r\n"
+		}
+		f.scripts[sha] = true
+		return f.reserve(args[2:])
+
+	case "EVALSHA":
+		if len(args) < 2 || !f.scripts[args[1]] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return f.reserve(args[2:])
+
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// reserve runs reserveScript: args are numkeys, the keys, then ARGV.
+func (f *fakeRedis) reserve(args []string) string {
+	if len(args) < 1 {
+		return "-ERR wrong number of arguments for 'evalsha' command\r\n"
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys < 0 || numKeys > len(args)-1 {
+		return "-ERR Number of keys can't be greater than number of args\r\n"
+	}
+
+	reply, err := f.run(args[1:1+numKeys], args[1+numKeys:])
+	if err != nil {
+		return fmt.Sprintf("-ERR Error running script: %v\r\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	}
+	return encodeLua(reply)
+}
+
+// run runs reserveScript with keys and argv, and returns what it returns.
+func (f *fakeRedis) run(keys, argv []string) (lua.LValue, error) {
+	toTable := func(values []string) *lua.LTable {
+		table := f.lua.NewTable()
+		for _, v := range values {
+			table.Append(lua.LString(v))
+		}
+		return table
+	}
+	f.lua.SetGlobal("KEYS", toTable(keys))
+	f.lua.SetGlobal("ARGV", toTable(argv))
+
+	top := f.lua.GetTop()
+	if err := f.lua.DoString(reserveScript); err != nil {
+		return nil, err
+	}
+	defer f.lua.SetTop(top)
+	return f.lua.Get(-1), nil
+}
+
+// call is redis.call, for the commands of reserveScript.
+func (f *fakeRedis) call(l *lua.LState) int {
+	args := make([]string, l.GetTop())
+	for i := range args {
+		args[i] = l.CheckString(i + 1)
+	}
+	if len(args) < 2 {
+		l.RaiseError("wrong number of arguments")
+	}
+	cmd, key := strings.ToUpper(args[0]), args[1]
+
+	hash := f.hashes[key]
+	if expires, ok := f.expires[key]; ok && !time.Now().Before(expires) {
+		hash = nil
+		delete(f.hashes, key)
+		delete(f.expires, key)
+	}
+
+	switch cmd {
+	case "HMGET":
+		// Missing fields are nil replies, which Redis turns into false.
+		reply := l.NewTable()
+		for _, field := range args[2:] {
+			if v, ok := hash[field]; ok {
+				reply.Append(lua.LString(v))
+			} else {
+				reply.Append(lua.LFalse)
+			}
+		}
+		l.Push(reply)
+	case "HSET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			l.RaiseError("wrong number of arguments for 'hset' command")
+		}
+		if hash == nil {
+			hash = map[string]string{}
+			f.hashes[key] = hash
+		}
+		for i := 2; i < len(args); i += 2 {
+			hash[args[i]] = args[i+1]
+		}
+		l.Push(lua.LNumber((len(args) - 2) / 2))
+	case "PEXPIRE":
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			l.RaiseError("value is not an integer or out of range")
+		}
+		if hash == nil {
+			l.Push(lua.LNumber(0))
+			break
+		}
+		f.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		l.Push(lua.LNumber(1))
+	default:
+		l.RaiseError("unknown command '%s'", cmd)
+	}
+	return 1
+}
+
+// encodeLua converts a value returned by a script to RESP, as Redis does:
+// numbers are truncated to integers, tables are arrays up to their first nil, and false is a nil reply.
+func encodeLua(v lua.LValue) string {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return fmt.Sprintf(":%d\r\n", int64(v))
+	case lua.LString:
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), string(v))
+	case lua.LBool:
+		if v {
+			return ":1\r\n"
+		}
+		return "$-1\r\n"
+	case *lua.LTable:
+		var items []string
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, encodeLua(item))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+	default:
+		return "$-1\r\n"
+	}
+}
+
+// setBucket stores the state of a bucket, as reserveScript would have left it at last.
+func (f *fakeRedis) setBucket(key string, tokens float64, last time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.hashes[key] = map[string]string{
+		"tokens": strconv.FormatFloat(tokens, 'g', -1, 64),
+		"last":   strconv.FormatInt(last.UnixNano()/int64(time.Microsecond), 10),
+	}
+}
+
+func (f *fakeRedis) commandLog() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+// reserve reserves tokens from a single bucket.
+func reserve(ctx context.Context, store BucketStore, key string, limit Limit, amount int64, now time.Time, maxDelay time.Duration) (Reservation, error) {
+	reservations, err := store.Reserve(ctx, key, []Limit{limit}, amount, now, maxDelay)
+	if err != nil {
+		return Reservation{}, err
+	}
+	if len(reservations) != 1 {
+		return Reservation{}, fmt.Errorf("expected 1 reservation; got %d", len(reservations))
+	}
+	return reservations[0], nil
+}
+
+func TestStoreReserve(t *testing.T) {
+	fake := newFakeRedis(t)
+	redisStore := NewRedisStore(fake.addr(), "test:")
+	defer func() { _ = redisStore.Close() }()
+
+	memStore, err := newMemoryStore(maxSources, OverflowEvict)
+	require.NoError(t, err)
+
+	stores := map[string]BucketStore{
+		"memory": memStore,
+		"redis":  redisStore,
+	}
+
+	for name, store := range stores {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			limit := Limit{Rate: 10, Burst: 5, TTL: time.Minute}
+			maxDelay := 50 * time.Millisecond
+			start := time.Now()
+			key := t.Name()
+
+			res, err := reserve(ctx, store, key, limit, 5, start, maxDelay)
+			require.NoError(t, err)
+			assert.True(t, res.OK)
+			assert.Equal(t, time.Duration(0), res.Delay)
+			assert.InDelta(t, 0, res.Tokens, 1e-6)
+
+			// One token comes back every 100ms: too late.
+			res, err = reserve(ctx, store, key, limit, 1, start, maxDelay)
+			require.NoError(t, err)
+			assert.False(t, res.OK)
+			assert.InDelta(t, 100*time.Millisecond, res.Delay, float64(time.Millisecond))
+
+			// Within maxDelay: the token is owed, and the request waits for it.
+			res, err = reserve(ctx, store, key, limit, 1, start.Add(60*time.Millisecond), maxDelay)
+			require.NoError(t, err)
+			assert.True(t, res.OK)
+			assert.InDelta(t, 40*time.Millisecond, res.Delay, float64(time.Millisecond))
+			assert.InDelta(t, -0.4, res.Tokens, 1e-6)
+
+			// The bucket never holds more than its burst.
+			res, err = reserve(ctx, store, key, limit, 1, start.Add(time.Hour/2), maxDelay)
+			require.NoError(t, err)
+			assert.True(t, res.OK)
+			assert.InDelta(t, 4, res.Tokens, 1e-6)
+
+			// More than the burst never fits.
+			res, err = reserve(ctx, store, key, limit, 6, start.Add(time.Hour/2), maxDelay)
+			require.NoError(t, err)
+			assert.False(t, res.OK)
+
+			// A bucket that is never refilled.
+			zero := Limit{Rate: 0, Burst: 1, TTL: time.Minute}
+			res, err = reserve(ctx, store, key+"/zero", zero, 1, start, maxDelay)
+			require.NoError(t, err)
+			assert.True(t, res.OK)
+			res, err = reserve(ctx, store, key+"/zero", zero, 1, start.Add(time.Second), maxDelay)
+			require.NoError(t, err)
+			assert.False(t, res.OK)
+			assert.Equal(t, rate.InfDuration, res.Delay)
+		})
+	}
+}
+
+// TestReserveScriptMatchesTake checks that reserveScript does the arithmetic of take.
+func TestReserveScriptMatchesTake(t *testing.T) {
+	fake := newFakeRedis(t)
+	store := NewRedisStore(fake.addr(), "test:")
+	defer func() { _ = store.Close() }()
+
+	limit := Limit{Rate: 10, Burst: 5, TTL: time.Minute}
+	now := time.Unix(1600000000, 0)
+
+	testCases := []struct {
+		desc     string
+		limit    Limit
+		fresh    bool // no bucket yet.
+		tokens   float64
+		elapsed  time.Duration // since the bucket held tokens.
+		amount   int64
+		maxDelay time.Duration
+	}{
+		{desc: "fresh bucket", limit: limit, fresh: true, amount: 1},
+		{desc: "fresh bucket, whole burst", limit: limit, fresh: true, amount: 5},
+		{desc: "partial refill", limit: limit, tokens: 1, elapsed: 150 * time.Millisecond, amount: 2},
+		{desc: "refill capped at burst", limit: limit, tokens: 3, elapsed: time.Hour, amount: 1},
+		{desc: "more than the burst", limit: limit, tokens: 5, amount: 6, maxDelay: time.Hour},
+		{desc: "delay within maxDelay", limit: limit, tokens: 0.5, elapsed: 20 * time.Millisecond, amount: 2, maxDelay: time.Second},
+		{desc: "delay over maxDelay", limit: limit, tokens: 0.5, elapsed: 20 * time.Millisecond, amount: 2, maxDelay: 100 * time.Millisecond},
+		{desc: "in debt", limit: limit, tokens: -2, elapsed: 50 * time.Millisecond, amount: 1, maxDelay: time.Second},
+		{desc: "never refilled", limit: Limit{Rate: 0, Burst: 1, TTL: time.Minute}, tokens: 0, elapsed: time.Second, amount: 1, maxDelay: time.Hour},
+		{desc: "refund while in debt", limit: limit, tokens: -3, elapsed: 10 * time.Millisecond, amount: -2},
+		{desc: "refund capped at burst", limit: limit, tokens: 4, elapsed: 50 * time.Millisecond, amount: -2},
+		{desc: "refund never refilled", limit: Limit{Rate: 0, Burst: 1, TTL: time.Minute}, tokens: -1, amount: -1},
+	}
+
+	for i, test := range testCases {
+		test := test
+		key := strconv.Itoa(i)
+		t.Run(test.desc, func(t *testing.T) {
+			tokens, last := float64(test.limit.Burst), now
+			if !test.fresh {
+				tokens, last = test.tokens, now.Add(-test.elapsed)
+				fake.setBucket("test:{"+key+"}:0", tokens, last)
+			}
+
+			want := take(tokens, last, test.limit, test.amount, now, test.maxDelay)
+			got, err := reserve(context.Background(), store, key, test.limit, test.amount, now, test.maxDelay)
+			require.NoError(t, err)
+
+			assert.Equal(t, want.OK, got.OK)
+			if want.Delay == rate.InfDuration {
+				assert.Equal(t, rate.InfDuration, got.Delay)
+			} else {
+				// The script counts in microseconds.
+				assert.InDelta(t, want.Delay, got.Delay, float64(time.Microsecond))
+			}
+			assert.InDelta(t, want.Tokens, got.Tokens, 1e-9)
+		})
+	}
+}
+
+func TestStoreReserveTiers(t *testing.T) {
+	fake := newFakeRedis(t)
+	redisStore := NewRedisStore(fake.addr(), "test:")
+	defer func() { _ = redisStore.Close() }()
+
+	memStore, err := newMemoryStore(maxSources, OverflowEvict)
+	require.NoError(t, err)
+
+	stores := map[string]BucketStore{
+		"memory": memStore,
+		"redis":  redisStore,
+	}
+
+	for name, store := range stores {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			limits := []Limit{
+				{Rate: 10, Burst: 5, TTL: time.Minute},
+				{Rate: 0.1, Burst: 3, TTL: time.Minute},
+			}
+			now := time.Now()
+			key := t.Name()
+
+			res, err := store.Reserve(ctx, key, limits, 3, now, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 2)
+			assert.True(t, res[0].OK)
+			assert.True(t, res[1].OK)
+			assert.InDelta(t, 2, res[0].Tokens, 1e-6)
+			assert.InDelta(t, 0, res[1].Tokens, 1e-6)
+
+			// The second tier is empty: the first one keeps its tokens.
+			res, err = store.Reserve(ctx, key, limits, 2, now, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 2)
+			assert.True(t, res[0].OK)
+			assert.False(t, res[1].OK)
+			assert.InDelta(t, 2, res[0].Tokens, 1e-6)
+			assert.InDelta(t, 0, res[1].Tokens, 1e-6)
+			assert.InDelta(t, 20*time.Second, res[1].Delay, float64(time.Millisecond))
+
+			res, err = store.Reserve(ctx, key, limits, 2, now.Add(20*time.Second), 0)
+			require.NoError(t, err)
+			require.Len(t, res, 2)
+			assert.True(t, res[0].OK)
+			assert.True(t, res[1].OK)
+			assert.InDelta(t, 3, res[0].Tokens, 1e-6)
+			assert.InDelta(t, 0, res[1].Tokens, 1e-6)
+		})
+	}
+}
+
+func TestRedisStoreLoadsScriptOnce(t *testing.T) {
+	fake := newFakeRedis(t)
+	store := NewRedisStore(fake.addr(), "test:")
+	defer func() { _ = store.Close() }()
+
+	limit := Limit{Rate: 10, Burst: 5, TTL: time.Minute}
+	for i := 0; i < 3; i++ {
+		_, err := store.Reserve(context.Background(), "source", []Limit{limit}, 1, time.Now(), 0)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, []string{"EVALSHA", "EVAL", "EVALSHA", "EVALSHA"}, fake.commandLog())
+}
+
+func TestRedisStoreAtomic(t *testing.T) {
+	fake := newFakeRedis(t)
+
+	// Two replicas, with their own connections, hammering the same bucket.
+	replicas := []*RedisStore{
+		NewRedisStore(fake.addr(), "test:"),
+		NewRedisStore(fake.addr(), "test:"),
+	}
+	defer func() {
+		for _, store := range replicas {
+			_ = store.Close()
+		}
+	}()
+
+	limit := Limit{Rate: 0.001, Burst: 50, TTL: time.Minute}
+	now := time.Now()
+
+	var mu sync.Mutex
+	allowed := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(store *RedisStore) {
+			defer wg.Done()
+
+			res, err := store.Reserve(context.Background(), "source", []Limit{limit}, 1, now, 0)
+			assert.NoError(t, err)
+			if len(res) == 1 && res[0].OK {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, allowed)
+}
+
+// TestRateLimitSharedStore checks that the replicas of a service sharing a RedisStore
+// let through the configured burst once, and not once per replica.
+func TestRateLimitSharedStore(t *testing.T) {
+	fake := newFakeRedis(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	config := dynamic.RateLimit{Average: 10, Period: ptypes.Duration(time.Minute), Burst: 10}
+
+	var replicas []http.Handler
+	for i := 0; i < 3; i++ {
+		store := NewRedisStore(fake.addr(), "rate-limiter:")
+		defer func() { _ = store.Close() }()
+
+		h, err := New(context.Background(), next, config, "rate-limiter", WithStore(store))
+		require.NoError(t, err)
+		replicas = append(replicas, h)
+	}
+
+	// One token every 6s: none comes back during the test.
+	allowed := 0
+	for i := 0; i < 30; i++ {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+
+		replicas[i%len(replicas)].ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			allowed++
+		}
+	}
+
+	assert.Equal(t, 10, allowed)
+}
+
+func TestRateLimitStoreUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 10}, "rate-limiter", WithStore(NewRedisStore(addr, "test:")))
+	require.NoError(t, err)
+
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestMemoryStoreOverflow(t *testing.T) {
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 2, TTL: 10 * time.Second}
+	now := time.Now()
+
+	t.Run("evict", func(t *testing.T) {
+		store, err := newMemoryStore(2, OverflowEvict)
+		require.NoError(t, err)
+
+		for _, key := range []string{"a", "b", "a"} {
+			_, err = reserve(ctx, store, key, limit, 1, now, 0)
+			require.NoError(t, err)
+		}
+
+		// b is the least recently seen: it makes room for c.
+		res, err := reserve(ctx, store, "c", limit, 1, now, 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+		assert.Equal(t, 2, store.Len())
+
+		// a still has its bucket, empty.
+		res, err = reserve(ctx, store, "a", limit, 1, now, 0)
+		require.NoError(t, err)
+		assert.False(t, res.OK)
+
+		// b gets a full one, as if it had never been seen. So does c, which made room for it.
+		res, err = reserve(ctx, store, "b", limit, 2, now, 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+		res, err = reserve(ctx, store, "c", limit, 2, now, 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		store, err := newMemoryStore(2, OverflowShared)
+		require.NoError(t, err)
+
+		for _, key := range []string{"a", "b"} {
+			res, err := reserve(ctx, store, key, limit, 2, now, 0)
+			require.NoError(t, err)
+			require.True(t, res.OK)
+		}
+
+		// The new sources share a bucket.
+		for _, key := range []string{"c", "d"} {
+			res, err := reserve(ctx, store, key, limit, 1, now, 0)
+			require.NoError(t, err)
+			assert.True(t, res.OK, key)
+		}
+		res, err := reserve(ctx, store, "e", limit, 1, now, 0)
+		require.NoError(t, err)
+		assert.False(t, res.OK)
+		assert.Equal(t, 2, store.Len())
+
+		// The known sources keep theirs.
+		res, err = reserve(ctx, store, "a", limit, 1, now, 0)
+		require.NoError(t, err)
+		assert.False(t, res.OK)
+
+		// Once a and b are forgotten, there is room again.
+		res, err = reserve(ctx, store, "e", limit, 2, now.Add(11*time.Second), 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+		res, err = reserve(ctx, store, "f", limit, 2, now.Add(11*time.Second), 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+	})
+
+	t.Run("shared by route", func(t *testing.T) {
+		store, err := newMemoryStore(2, OverflowShared)
+		require.NoError(t, err)
+
+		login := []Limit{{Rate: 1, Burst: 1, TTL: 10 * time.Second}}
+		search := []Limit{{Rate: 10, Burst: 3, TTL: 10 * time.Second}, {Rate: 1, Burst: 5, TTL: time.Minute}}
+
+		for _, key := range []string{"0:a", "1:a"} {
+			_, err := store.Reserve(ctx, key, login, 1, now, 0)
+			require.NoError(t, err)
+		}
+
+		// Each route has its own shared buckets, with its own limits,
+		// which are not reset when the routes take turns.
+		reservations, err := store.Reserve(ctx, "1:b", search, 1, now, 0)
+		require.NoError(t, err)
+		assert.True(t, reservations[0].OK)
+		reservations, err = store.Reserve(ctx, "0:b", login, 1, now, 0)
+		require.NoError(t, err)
+		assert.True(t, reservations[0].OK)
+
+		reservations, err = store.Reserve(ctx, "1:c", search, 1, now, 0)
+		require.NoError(t, err)
+		assert.True(t, reservations[0].OK)
+		assert.InDelta(t, 1, reservations[0].Tokens, 1e-6)
+		assert.InDelta(t, 3, reservations[1].Tokens, 1e-6)
+		reservations, err = store.Reserve(ctx, "0:c", login, 1, now, 0)
+		require.NoError(t, err)
+		assert.False(t, reservations[0].OK)
+
+		assert.Equal(t, 2, store.Len())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		store, err := newMemoryStore(2, OverflowReject)
+		require.NoError(t, err)
+
+		_, err = reserve(ctx, store, "a", limit, 1, now, 0)
+		require.NoError(t, err)
+		_, err = reserve(ctx, store, "b", limit, 1, now.Add(time.Second), 0)
+		require.NoError(t, err)
+
+		// The new source may retry once a is forgotten.
+		res, err := reserve(ctx, store, "c", limit, 1, now.Add(2*time.Second), 0)
+		require.NoError(t, err)
+		assert.False(t, res.OK)
+		assert.Equal(t, 8*time.Second, res.Delay)
+		assert.Equal(t, 2, store.Len())
+
+		res, err = reserve(ctx, store, "b", limit, 1, now.Add(2*time.Second), 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+
+		res, err = reserve(ctx, store, "c", limit, 1, now.Add(10*time.Second), 0)
+		require.NoError(t, err)
+		assert.True(t, res.OK)
+	})
+}
+
+func TestNewRateLimiterCapacity(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		opts          []Option
+		expectedError string
+	}{
+		{
+			desc: "capacity",
+			opts: []Option{WithCapacity(10, OverflowShared)},
+		},
+		{
+			desc:          "no capacity",
+			opts:          []Option{WithCapacity(0, OverflowEvict)},
+			expectedError: "capacity must be positive: 0",
+		},
+		{
+			desc:          "unknown overflow policy",
+			opts:          []Option{WithCapacity(10, Overflow(42))},
+			expectedError: "unknown overflow policy: 42",
+		},
+		{
+			desc:          "capacity of another store",
+			opts:          []Option{WithCapacity(10, OverflowEvict), WithStore(NewRedisStore("127.0.0.1:0", "test:"))},
+			expectedError: "capacity only applies to the default store",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10}, "rate-limiter", test.opts...)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestRateLimitSourceFlood floods a rate limiter with requests from many more spoofed IPs than it has room for,
+// while a legitimate client keeps sending requests. The client never gets an error,
+// and unless the flood is allowed to evict its bucket, it is limited to its burst, no more.
+func TestRateLimitSourceFlood(t *testing.T) {
+	const (
+		capacity  = 100
+		flooders  = 8
+		floodSize = 2000
+		burst     = 5
+	)
+
+	testCases := []struct {
+		desc     string
+		overflow Overflow
+	}{
+		{desc: "evict", overflow: OverflowEvict},
+		{desc: "shared", overflow: OverflowShared},
+		{desc: "reject", overflow: OverflowReject},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			// One token per second: none comes back during the test.
+			h, err := New(context.Background(), next, dynamic.RateLimit{Average: 1, Burst: burst}, "rate-limiter",
+				WithMode(ModeReject), WithCapacity(capacity, test.overflow))
+			require.NoError(t, err)
+
+			serve := func(remoteAddr string) int {
+				req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+				req.RemoteAddr = remoteAddr
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			legit := "192.0.2.1:1234"
+			require.Equal(t, http.StatusOK, serve(legit))
+
+			var mu sync.Mutex
+			codes := make(map[int]int)
+			var wg sync.WaitGroup
+			for f := 0; f < flooders; f++ {
+				wg.Add(1)
+				go func(f int) {
+					defer wg.Done()
+					for i := 0; i < floodSize; i++ {
+						code := serve(fmt.Sprintf("10.%d.%d.%d:1234", f, i/256, i%256))
+						mu.Lock()
+						codes[code]++
+						mu.Unlock()
+					}
+				}(f)
+			}
+
+			allowed := 1
+			for i := 0; i < 3*burst; i++ {
+				code := serve(legit)
+				mu.Lock()
+				codes[code]++
+				mu.Unlock()
+				if code == http.StatusOK {
+					allowed++
+				}
+				time.Sleep(time.Millisecond)
+			}
+			wg.Wait()
+
+			assert.Zero(t, codes[http.StatusInternalServerError])
+			assert.Equal(t, flooders*floodSize+3*burst, codes[http.StatusOK]+codes[http.StatusTooManyRequests])
+
+			switch test.overflow {
+			case OverflowEvict:
+				assert.GreaterOrEqual(t, allowed, burst)
+			case OverflowShared:
+				assert.Equal(t, burst, allowed)
+				// The flood gets the buckets of the sources that fit, and a shared one.
+				assert.LessOrEqual(t, codes[http.StatusOK], (capacity-1)*burst+burst+burst)
+			case OverflowReject:
+				assert.Equal(t, burst, allowed)
+				assert.LessOrEqual(t, codes[http.StatusOK], (capacity-1)*burst+burst)
+			}
+		})
+	}
+}
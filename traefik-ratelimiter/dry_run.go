@@ -0,0 +1,42 @@
+package ratelimiter
+
+import "sync/atomic"
+
+// DryRun is a switch that turns the rate limiters it is given to into observers:
+// while it is on, they make the same decisions, log and count them,
+// but let every request through right away.
+// It may be flipped at any time, e.g. from an admin endpoint, to try out limits before enforcing them.
+type DryRun struct {
+	on int32
+}
+
+// NewDryRun returns a DryRun switch, on or off.
+func NewDryRun(on bool) *DryRun {
+	d := &DryRun{}
+	d.Set(on)
+	return d
+}
+
+// WithDryRun lets every request through while d is on.
+// The requests that would be rejected or delayed are logged,
+// and counted with the would_reject and would_delay outcomes by Metrics.
+// Exemptions still apply first, and the RateLimit-* headers are not sent.
+func WithDryRun(d *DryRun) Option {
+	return func(rl *rateLimiter) {
+		rl.dryRun = d
+	}
+}
+
+// Set turns d on or off.
+func (d *DryRun) Set(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&d.on, v)
+}
+
+// Enabled reports whether d is on. A nil DryRun is off.
+func (d *DryRun) Enabled() bool {
+	return d != nil && atomic.LoadInt32(&d.on) == 1
+}
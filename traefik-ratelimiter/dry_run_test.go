@@ -0,0 +1,89 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestRateLimitDryRun(t *testing.T) {
+	served := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ })
+
+	// One token every 100ms and a maxDelay of 50ms: all but the first request would be rejected.
+	metrics := NewMetrics()
+	dryRun := NewDryRun(true)
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithMetrics(metrics), WithDryRun(dryRun))
+	require.NoError(t, err)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		w := serve()
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+		assert.Empty(t, w.Header().Get("Retry-After"))
+	}
+	assert.Equal(t, 3, served)
+	assert.Equal(t, map[string]uint64{outcomeAllowed: 1, outcomeWouldReject: 2}, metrics.requests["rate-limiter"])
+
+	// Switched off, the same buckets are enforced.
+	dryRun.Set(false)
+	w := serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, 3, served)
+	assert.Equal(t, uint64(1), metrics.requests["rate-limiter"][outcomeRejected])
+}
+
+func TestRateLimitDryRunDelay(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	metrics := NewMetrics()
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 1, Burst: 1}, "rate-limiter",
+		WithMetrics(metrics), WithDryRun(NewDryRun(true)), WithMaxDelay(time.Minute))
+	require.NoError(t, err)
+
+	// The second request would wait for about a second, but is let through right away.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, map[string]uint64{outcomeAllowed: 1, outcomeWouldDelay: 1}, metrics.requests["rate-limiter"])
+}
+
+func TestRateLimitDryRunDenyAll(t *testing.T) {
+	served := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true })
+
+	metrics := NewMetrics()
+	h, err := New(context.Background(), next, dynamic.RateLimit{}, "rate-limiter",
+		DenyAll(), WithMetrics(metrics), WithDryRun(NewDryRun(true)))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+	assert.True(t, served)
+	assert.Equal(t, map[string]uint64{outcomeWouldReject: 1}, metrics.requests["rate-limiter"])
+}
@@ -0,0 +1,154 @@
+package ratelimiter
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/middlewares"
+	"github.com/vulcand/oxy/utils"
+)
+
+// Exemptions are the requests that bypass the rate limiter, such as those of health checkers and internal jobs.
+// They take no tokens and get no RateLimit-* headers, but are counted by Metrics as "bypassed".
+// They bypass DenyAll too.
+type Exemptions struct {
+	// SourceRange lists the CIDRs, or single IPs, of the clients that are not rate limited.
+	SourceRange []string
+	// IPStrategy picks the client IP checked against SourceRange, as in dynamic.SourceCriterion.
+	// By default it is the address of the peer.
+	IPStrategy *dynamic.IPStrategy
+	// A request with one of Tokens in its HeaderName header is not rate limited.
+	HeaderName string
+	Tokens     []string
+	// Methods are the HTTP methods not rate limited, e.g. OPTIONS for CORS preflights.
+	Methods []string
+}
+
+// WithExemptions lets the requests described by exemptions through without rate limiting them.
+func WithExemptions(exemptions Exemptions) Option {
+	return func(rl *rateLimiter) {
+		rl.exemptionConfig = &exemptions
+	}
+}
+
+// exemptions are Exemptions ready to be checked.
+type exemptions struct {
+	nets        []*net.IPNet
+	ipExtractor utils.SourceExtractor
+	header      string
+	tokens      [][]byte
+	methods     map[string]bool
+}
+
+func newExemptions(ctx context.Context, config Exemptions) (*exemptions, error) {
+	e := &exemptions{
+		header:  config.HeaderName,
+		methods: make(map[string]bool),
+	}
+
+	for _, r := range config.SourceRange {
+		n, err := parseNet(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source range %q: %w", r, err)
+		}
+		e.nets = append(e.nets, n)
+	}
+	if len(e.nets) > 0 {
+		ipStrategy := config.IPStrategy
+		if ipStrategy == nil {
+			ipStrategy = &dynamic.IPStrategy{}
+		}
+		var err error
+		e.ipExtractor, err = middlewares.GetSourceExtractor(ctx, &dynamic.SourceCriterion{IPStrategy: ipStrategy})
+		if err != nil {
+			return nil, err
+		}
+	} else if config.IPStrategy != nil {
+		return nil, errors.New("IPStrategy is set without a SourceRange")
+	}
+
+	if config.HeaderName != "" && len(config.Tokens) == 0 {
+		return nil, fmt.Errorf("no tokens for header %s", config.HeaderName)
+	}
+	if config.HeaderName == "" && len(config.Tokens) > 0 {
+		return nil, errors.New("tokens are set without a HeaderName")
+	}
+	for _, token := range config.Tokens {
+		if token == "" {
+			return nil, errors.New("empty token")
+		}
+		e.tokens = append(e.tokens, []byte(token))
+	}
+
+	for _, method := range config.Methods {
+		if method == "" || strings.ContainsAny(method, " \t()<>@,;:\\\"/[]?={}") {
+			return nil, fmt.Errorf("invalid method %q", method)
+		}
+		e.methods[strings.ToUpper(method)] = true
+	}
+
+	return e, nil
+}
+
+// parseNet parses a CIDR, or a single IP as the network of that IP alone.
+// Surrounding spaces are ignored.
+func parseNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "IP address", Text: s}
+	}
+	// An IPv4-mapped IPv6 address stands for the IPv4 one alone, not an IPv6 /32.
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// exempt tells whether r bypasses the rate limiter, and why.
+func (e *exemptions) exempt(r *http.Request) (bool, string) {
+	if e == nil {
+		return false, ""
+	}
+
+	if e.methods[r.Method] {
+		return true, "method " + r.Method
+	}
+
+	if e.header != "" {
+		if value := []byte(r.Header.Get(e.header)); len(value) > 0 {
+			for _, token := range e.tokens {
+				if subtle.ConstantTimeCompare(value, token) == 1 {
+					return true, "header " + e.header
+				}
+			}
+		}
+	}
+
+	if len(e.nets) > 0 {
+		source, _, err := e.ipExtractor.Extract(r)
+		if err != nil {
+			return false, ""
+		}
+		if ip := net.ParseIP(source); ip != nil {
+			for _, n := range e.nets {
+				if n.Contains(ip) {
+					return true, "source range " + n.String()
+				}
+			}
+		}
+	}
+
+	return false, ""
+}
@@ -0,0 +1,194 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestNewRateLimiterExemptions(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		exemptions    Exemptions
+		expectedError string
+	}{
+		{
+			desc: "all of them",
+			exemptions: Exemptions{
+				SourceRange: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::1"},
+				IPStrategy:  &dynamic.IPStrategy{Depth: 1},
+				HeaderName:  "X-Bypass-Token",
+				Tokens:      []string{"secret"},
+				Methods:     []string{"OPTIONS", "head"},
+			},
+		},
+		{
+			desc:       "none of them",
+			exemptions: Exemptions{},
+		},
+		{
+			desc:          "invalid source range",
+			exemptions:    Exemptions{SourceRange: []string{"10.0.0.0/33"}},
+			expectedError: `exemptions: invalid source range "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33`,
+		},
+		{
+			desc:          "IP strategy without source range",
+			exemptions:    Exemptions{IPStrategy: &dynamic.IPStrategy{Depth: 1}},
+			expectedError: "exemptions: IPStrategy is set without a SourceRange",
+		},
+		{
+			desc:          "header without tokens",
+			exemptions:    Exemptions{HeaderName: "X-Bypass-Token"},
+			expectedError: "exemptions: no tokens for header X-Bypass-Token",
+		},
+		{
+			desc:          "tokens without header",
+			exemptions:    Exemptions{Tokens: []string{"secret"}},
+			expectedError: "exemptions: tokens are set without a HeaderName",
+		},
+		{
+			desc:          "empty token",
+			exemptions:    Exemptions{HeaderName: "X-Bypass-Token", Tokens: []string{"secret", ""}},
+			expectedError: "exemptions: empty token",
+		},
+		{
+			desc:          "invalid method",
+			exemptions:    Exemptions{Methods: []string{"GET POST"}},
+			expectedError: `exemptions: invalid method "GET POST"`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10}, "rate-limiter", WithExemptions(test.exemptions))
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseNet(t *testing.T) {
+	valid := map[string]string{
+		"10.0.0.0/8":       "10.0.0.0/8",
+		"10.1.2.3/8":       "10.0.0.0/8",
+		" 192.0.2.1 ":      "192.0.2.1/32",
+		"::ffff:192.0.2.1": "192.0.2.1/32",
+		"2001:db8::1":      "2001:db8::1/128",
+		"2001:db8::/32":    "2001:db8::/32",
+	}
+	for s, expected := range valid {
+		n, err := parseNet(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, expected, n.String(), s)
+		}
+	}
+
+	for _, s := range []string{"", "not-a-cidr", "192.0.2", "10.0.0.0/33", "10.0.0.0/", "[::1]"} {
+		_, err := parseNet(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestRateLimitExemptions(t *testing.T) {
+	exemptions := Exemptions{
+		SourceRange: []string{"10.0.0.0/8", "192.0.2.1"},
+		HeaderName:  "X-Bypass-Token",
+		Tokens:      []string{"first", "second"},
+		Methods:     []string{"options"},
+	}
+
+	testCases := []struct {
+		desc       string
+		remoteAddr string
+		method     string
+		headers    map[string]string
+		bypassed   bool
+	}{
+		{desc: "in a source range", remoteAddr: "10.1.2.3:1234", bypassed: true},
+		{desc: "single IP", remoteAddr: "192.0.2.1:1234", bypassed: true},
+		{desc: "out of the source ranges", remoteAddr: "192.0.2.2:1234"},
+		{desc: "token", remoteAddr: "192.0.2.2:1234", headers: map[string]string{"X-Bypass-Token": "second"}, bypassed: true},
+		{desc: "wrong token", remoteAddr: "192.0.2.2:1234", headers: map[string]string{"X-Bypass-Token": "third"}},
+		{desc: "token prefix", remoteAddr: "192.0.2.2:1234", headers: map[string]string{"X-Bypass-Token": "firs"}},
+		{desc: "token in another header", remoteAddr: "192.0.2.2:1234", headers: map[string]string{"Authorization": "first"}},
+		{desc: "excluded method", remoteAddr: "192.0.2.2:1234", method: http.MethodOptions, bypassed: true},
+		{desc: "other method", remoteAddr: "192.0.2.2:1234", method: http.MethodPost},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			metrics := NewMetrics()
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			// One token every 100ms and a maxDelay of 50ms: none comes back during the test.
+			h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+				WithExemptions(exemptions), WithMetrics(metrics))
+			require.NoError(t, err)
+
+			var codes []int
+			var headers []string
+			for i := 0; i < 3; i++ {
+				method := test.method
+				if method == "" {
+					method = http.MethodGet
+				}
+				req := testhelpers.MustNewRequest(method, "http://localhost", nil)
+				req.RemoteAddr = test.remoteAddr
+				for k, v := range test.headers {
+					req.Header.Set(k, v)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, req)
+				codes = append(codes, w.Code)
+				headers = append(headers, w.Header().Get("RateLimit-Remaining"))
+			}
+
+			w := httptest.NewRecorder()
+			metrics.ServeHTTP(w, testhelpers.MustNewRequest(http.MethodGet, "http://localhost/metrics", nil))
+			lines := strings.Split(w.Body.String(), "\n")
+
+			if test.bypassed {
+				assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK}, codes)
+				assert.Equal(t, []string{"", "", ""}, headers)
+				assert.Contains(t, lines, `traefik_ratelimiter_requests_total{middleware="rate-limiter",outcome="bypassed"} 3`)
+			} else {
+				assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}, codes)
+				assert.NotContains(t, w.Body.String(), "bypassed")
+			}
+		})
+	}
+}
+
+func TestRateLimitExemptionsDenyAll(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10}, "rate-limiter",
+		DenyAll(), WithExemptions(Exemptions{SourceRange: []string{"127.0.0.1"}}))
+	require.NoError(t, err)
+
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req.RemoteAddr = "127.0.0.2:1234"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
@@ -0,0 +1,202 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The outcomes of a request, as counted by Metrics.
+const (
+	// outcomeAllowed is a request let through right away.
+	outcomeAllowed = "allowed"
+	// outcomeDelayed is a request let through after waiting for its tokens.
+	outcomeDelayed = "delayed"
+	// outcomeRejected is a request answered with a 429.
+	outcomeRejected = "rejected"
+	// outcomeCanceled is a request whose client went away while it was waiting.
+	outcomeCanceled = "canceled"
+	// outcomeBypassed is a request let through by Exemptions.
+	outcomeBypassed = "bypassed"
+	// outcomeWouldReject is a request that would have been rejected, let through by a DryRun.
+	outcomeWouldReject = "would_reject"
+	// outcomeWouldDelay is a request that would have waited for its tokens, let through right away by a DryRun.
+	outcomeWouldDelay = "would_delay"
+)
+
+// delayBuckets are the upper bounds, in seconds, of the buckets of the delay histogram.
+var delayBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Metrics counts what the rate limiters it is given to do, by middleware name,
+// and serves the counts in the OpenMetrics text format, e.g. on a /metrics route:
+//
+//	metrics := ratelimiter.NewMetrics()
+//	h, err := ratelimiter.New(ctx, next, config, name, ratelimiter.WithMetrics(metrics))
+//	mux.Handle("/metrics", metrics)
+//
+// Several middlewares may share it; a middleware that is created again under the same name,
+// when the configuration is reloaded, keeps adding to the same series.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[string]map[string]uint64 // by middleware, then outcome.
+	delays   map[string]*histogram        // by middleware.
+	stores   map[string]lenStore          // by middleware.
+}
+
+// lenStore is a BucketStore that knows how many buckets it holds, such as the default memory store.
+type lenStore interface {
+	Len() int
+}
+
+// histogram is a cumulative histogram over delayBuckets.
+type histogram struct {
+	counts []uint64 // one per delayBuckets, then +Inf.
+	sum    float64
+}
+
+// NewMetrics returns empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[string]map[string]uint64),
+		delays:   make(map[string]*histogram),
+		stores:   make(map[string]lenStore),
+	}
+}
+
+// WithMetrics counts the requests of the middleware in metrics.
+func WithMetrics(metrics *Metrics) Option {
+	return func(rl *rateLimiter) {
+		rl.metrics = metrics
+	}
+}
+
+// register reports the number of buckets of store under the name of a middleware,
+// if store can tell; a RedisStore cannot.
+func (m *Metrics) register(name string, store BucketStore) {
+	if m == nil {
+		return
+	}
+	s, ok := store.(lenStore)
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stores[name] = s
+}
+
+// observe counts a request of the middleware name. The delay of the requests let through,
+// zero or not, goes to the histogram. It does nothing on nil Metrics.
+func (m *Metrics) observe(name, outcome string, delay time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requests[name] == nil {
+		m.requests[name] = make(map[string]uint64)
+	}
+	m.requests[name][outcome]++
+
+	if outcome != outcomeAllowed && outcome != outcomeDelayed {
+		return
+	}
+	h := m.delays[name]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(delayBuckets)+1)}
+		m.delays[name] = h
+	}
+	seconds := delay.Seconds()
+	for i, le := range delayBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(delayBuckets)]++
+	h.sum += seconds
+}
+
+// ServeHTTP writes the metrics in the OpenMetrics text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	_ = m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# TYPE traefik_ratelimiter_requests counter\n")
+	b.WriteString("# HELP traefik_ratelimiter_requests Requests seen by the rate limiter, by outcome.\n")
+	var names []string
+	for name := range m.requests {
+		names = append(names, name)
+	}
+	for _, name := range sorted(names) {
+		outcomes := m.requests[name]
+		var keys []string
+		for outcome := range outcomes {
+			keys = append(keys, outcome)
+		}
+		for _, outcome := range sorted(keys) {
+			fmt.Fprintf(&b, "traefik_ratelimiter_requests_total{middleware=%s,outcome=%s} %d\n",
+				quote(name), quote(outcome), outcomes[outcome])
+		}
+	}
+
+	b.WriteString("# TYPE traefik_ratelimiter_delay_seconds histogram\n")
+	b.WriteString("# HELP traefik_ratelimiter_delay_seconds Time the requests let through waited for their tokens.\n")
+	names = names[:0]
+	for name := range m.delays {
+		names = append(names, name)
+	}
+	for _, name := range sorted(names) {
+		h := m.delays[name]
+		for i, le := range delayBuckets {
+			fmt.Fprintf(&b, "traefik_ratelimiter_delay_seconds_bucket{middleware=%s,le=%s} %d\n",
+				quote(name), quote(formatFloat(le)), h.counts[i])
+		}
+		fmt.Fprintf(&b, "traefik_ratelimiter_delay_seconds_bucket{middleware=%s,le=\"+Inf\"} %d\n", quote(name), h.counts[len(delayBuckets)])
+		fmt.Fprintf(&b, "traefik_ratelimiter_delay_seconds_sum{middleware=%s} %s\n", quote(name), formatFloat(h.sum))
+		fmt.Fprintf(&b, "traefik_ratelimiter_delay_seconds_count{middleware=%s} %d\n", quote(name), h.counts[len(delayBuckets)])
+	}
+
+	b.WriteString("# TYPE traefik_ratelimiter_buckets gauge\n")
+	b.WriteString("# HELP traefik_ratelimiter_buckets Token buckets kept by the rate limiter.\n")
+	names = names[:0]
+	for name := range m.stores {
+		names = append(names, name)
+	}
+	for _, name := range sorted(names) {
+		fmt.Fprintf(&b, "traefik_ratelimiter_buckets{middleware=%s} %d\n", quote(name), m.stores[name].Len())
+	}
+
+	b.WriteString("# EOF\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quote escapes a label value.
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sorted(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,108 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+	"golang.org/x/time/rate"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	store, err := newMemoryStore(maxSources, OverflowEvict)
+	require.NoError(t, err)
+	limits := []Limit{{Rate: rate.Limit(1), Burst: 1, TTL: time.Second}}
+	for _, key := range []string{"10.0.0.1", "10.0.0.2"} {
+		_, err := store.Reserve(context.Background(), key, limits, 1, time.Now(), 0)
+		require.NoError(t, err)
+	}
+
+	m := NewMetrics()
+	m.register("api", store)
+	m.register("redis", NewRedisStore("127.0.0.1:0", "test:"))
+	m.observe("api", outcomeAllowed, 0)
+	m.observe("api", outcomeDelayed, 30*time.Millisecond)
+	m.observe("api", outcomeDelayed, 2*time.Second)
+	m.observe("api", outcomeRejected, 0)
+	m.observe(`we"ird`, outcomeCanceled, 0)
+
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost/metrics", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, req)
+
+	assert.Equal(t, "application/openmetrics-text; version=1.0.0; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `# TYPE traefik_ratelimiter_requests counter
+# HELP traefik_ratelimiter_requests Requests seen by the rate limiter, by outcome.
+traefik_ratelimiter_requests_total{middleware="api",outcome="allowed"} 1
+traefik_ratelimiter_requests_total{middleware="api",outcome="delayed"} 2
+traefik_ratelimiter_requests_total{middleware="api",outcome="rejected"} 1
+traefik_ratelimiter_requests_total{middleware="we\"ird",outcome="canceled"} 1
+# TYPE traefik_ratelimiter_delay_seconds histogram
+# HELP traefik_ratelimiter_delay_seconds Time the requests let through waited for their tokens.
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.001"} 1
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.005"} 1
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.01"} 1
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.025"} 1
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.05"} 2
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.1"} 2
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.25"} 2
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="0.5"} 2
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="1"} 2
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="2.5"} 3
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="5"} 3
+traefik_ratelimiter_delay_seconds_bucket{middleware="api",le="+Inf"} 3
+traefik_ratelimiter_delay_seconds_sum{middleware="api"} 2.03
+traefik_ratelimiter_delay_seconds_count{middleware="api"} 3
+# TYPE traefik_ratelimiter_buckets gauge
+# HELP traefik_ratelimiter_buckets Token buckets kept by the rate limiter.
+traefik_ratelimiter_buckets{middleware="api"} 2
+# EOF
+`, w.Body.String())
+}
+
+func TestMetricsEmpty(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewMetrics().ServeHTTP(w, testhelpers.MustNewRequest(http.MethodGet, "http://localhost/metrics", nil))
+
+	assert.Equal(t, `# TYPE traefik_ratelimiter_requests counter
+# HELP traefik_ratelimiter_requests Requests seen by the rate limiter, by outcome.
+# TYPE traefik_ratelimiter_delay_seconds histogram
+# HELP traefik_ratelimiter_delay_seconds Time the requests let through waited for their tokens.
+# TYPE traefik_ratelimiter_buckets gauge
+# HELP traefik_ratelimiter_buckets Token buckets kept by the rate limiter.
+# EOF
+`, w.Body.String())
+}
+
+func TestRateLimitMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// One token every 100ms: the second request waits for about that long,
+	// the third one, which costs 2 tokens, would wait for twice as long.
+	h := newWeightedRateLimiter(t, dynamic.RateLimit{Average: 10, Burst: 2}, next,
+		WithMaxDelay(150*time.Millisecond), WithMetrics(metrics))
+
+	assert.Equal(t, http.StatusOK, serveWithCost(h, 2).Code)
+	assert.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serveWithCost(h, 2).Code)
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, testhelpers.MustNewRequest(http.MethodGet, "http://localhost/metrics", nil))
+	lines := strings.Split(w.Body.String(), "\n")
+
+	assert.Contains(t, lines, `traefik_ratelimiter_requests_total{middleware="rate-limiter",outcome="allowed"} 1`)
+	assert.Contains(t, lines, `traefik_ratelimiter_requests_total{middleware="rate-limiter",outcome="delayed"} 1`)
+	assert.Contains(t, lines, `traefik_ratelimiter_requests_total{middleware="rate-limiter",outcome="rejected"} 1`)
+	assert.Contains(t, lines, `traefik_ratelimiter_delay_seconds_bucket{middleware="rate-limiter",le="0.05"} 1`)
+	assert.Contains(t, lines, `traefik_ratelimiter_delay_seconds_bucket{middleware="rate-limiter",le="0.25"} 2`)
+	assert.Contains(t, lines, `traefik_ratelimiter_delay_seconds_count{middleware="rate-limiter"} 2`)
+	assert.Contains(t, lines, `traefik_ratelimiter_buckets{middleware="rate-limiter"} 1`)
+}
@@ -3,12 +3,14 @@ package ratelimiter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/mailgun/ttlmap"
 	"github.com/opentracing/opentracing-go/ext"
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"github.com/traefik/traefik/v2/pkg/log"
@@ -21,6 +23,24 @@ import (
 const (
 	typeName   = "RateLimiterType"
 	maxSources = 65536
+
+	// statusClientClosedRequest is the non-standard status logged for requests whose client went away.
+	statusClientClosedRequest = 499
+)
+
+// Mode decides what happens to a request whose tokens are not in its bucket yet.
+type Mode int
+
+const (
+	// ModeDelay delays the request until its tokens come back, if they do within maxDelay.
+	// It smooths out small bursts, and rejects the rest. It is the default.
+	ModeDelay Mode = iota
+	// ModeReject rejects the request right away.
+	ModeReject
+	// ModeQueue queues the requests of each source in arrival order, each waiting for its turn.
+	// The queue holds as many tokens as the bucket: a request that would wait longer than
+	// the bucket takes to refill (or than maxDelay, if set) is rejected.
+	ModeQueue
 )
 
 // rateLimiter implements rate limiting and traffic shaping with a set of token buckets;
@@ -30,21 +50,141 @@ type rateLimiter struct {
 	rate  rate.Limit // reqs/s
 	burst int64
 	// maxDelay is the maximum duration we're willing to wait for a bucket reservation to become effective, in nanoseconds.
-	// For now it is somewhat arbitrarily set to 1/(2*rate).
-	maxDelay time.Duration
-	// each rate limiter for a given source is stored in the buckets ttlmap.
-	// To keep this ttlmap constrained in size,
-	// each ratelimiter is "garbage collected" when it is considered expired.
+	// Unless set with WithMaxDelay, it is somewhat arbitrarily set to 1/(2*rate) in ModeDelay.
+	maxDelay    time.Duration
+	maxDelaySet bool
+	mode        Mode
+	// each bucket for a given source is kept in the store.
+	// To keep the store constrained in size,
+	// each bucket is "garbage collected" when it is considered expired.
 	// It is considered expired after it hasn't been used for ttl seconds.
 	ttl           int
 	sourceMatcher utils.SourceExtractor
-	next          http.Handler
+	// sourceParts, if any, make up the source instead of the SourceCriterion.
+	sourceParts []SourcePart
+	// exemptions are the requests let through without taking tokens, from exemptionConfig.
+	exemptionConfig *Exemptions
+	exemptions      *exemptions
+	// cost, if positive, is the number of tokens every request reserves,
+	// instead of the amount reported by sourceMatcher.
+	cost int64
+	// tiers are the limits enforced along with rate and burst.
+	tiers []Tier
+	// limits are the buckets of each source: the one of rate and burst, then one per tier.
+	limits []Limit
+	// maxAmount is the smallest burst of limits: a request may not reserve more.
+	maxAmount int64
+	// policy is the value of the RateLimit-Policy header.
+	policy string
+	// routes override limits for some of the requests; defaultRoute has limits, for the others.
+	routeConfigs []Route
+	routes       []*route
+	defaultRoute *route
+	// denyAll rejects every request.
+	denyAll bool
+	// hideHeaders turns off the RateLimit-* headers.
+	hideHeaders bool
+	// renderer, if set, writes the 429 responses, from rejectionTemplate or the problem details.
+	rejectionTemplate *RejectionTemplate
+	renderer          renderer
+	// metrics, if set, counts the outcome of every request.
+	metrics *Metrics
+	// dryRun, while on, lets the requests through instead of rejecting or delaying them.
+	dryRun *DryRun
+	// hashSpanKeys tags the spans with a hash of the key of a request, instead of the key.
+	hashSpanKeys bool
+	next         http.Handler
+
+	store BucketStore // actual buckets, keyed by source.
+	// capacity and overflow configure the default store.
+	capacity    int
+	overflow    Overflow
+	capacitySet bool
+}
+
+// Option configures what dynamic.RateLimit does not cover.
+type Option func(*rateLimiter)
+
+// WithCost makes every request reserve cost tokens,
+// e.g. on a route that is more expensive to serve than the others.
+// It overrides the amount reported by the source extractor.
+func WithCost(cost int64) Option {
+	return func(rl *rateLimiter) {
+		rl.cost = cost
+	}
+}
 
-	buckets *ttlmap.TtlMap // actual buckets, keyed by source.
+// Tier is a limit enforced along with the one of dynamic.RateLimit,
+// e.g. 1000 requests per hour on top of 20 per second.
+// Its fields mean the same as those of dynamic.RateLimit.
+type Tier struct {
+	Average int64
+	Period  time.Duration
+	Burst   int64
+}
+
+// WithTiers adds limits that every request must fit in, along with the one of dynamic.RateLimit.
+// Unlike with a chain of middlewares, a request takes its tokens from all of them, or from none:
+// a request rejected by one tier does not use up the others.
+func WithTiers(tiers ...Tier) Option {
+	return func(rl *rateLimiter) {
+		rl.tiers = append(rl.tiers, tiers...)
+	}
+}
+
+// WithStore keeps the buckets in store instead of the memory of this traefik instance,
+// e.g. a RedisStore shared by all the replicas behind a load balancer.
+func WithStore(store BucketStore) Option {
+	return func(rl *rateLimiter) {
+		rl.store = store
+	}
+}
+
+// WithCapacity keeps the buckets of up to capacity sources in memory, instead of 65536,
+// and sets what happens to the requests of new sources once they are all taken.
+// It does not apply to a store set with WithStore.
+func WithCapacity(capacity int, overflow Overflow) Option {
+	return func(rl *rateLimiter) {
+		rl.capacity = capacity
+		rl.overflow = overflow
+		rl.capacitySet = true
+	}
+}
+
+// WithMode selects what happens to a request whose tokens are not available yet.
+func WithMode(mode Mode) Option {
+	return func(rl *rateLimiter) {
+		rl.mode = mode
+	}
+}
+
+// WithMaxDelay sets how long a request may wait for its tokens in ModeDelay and ModeQueue.
+func WithMaxDelay(maxDelay time.Duration) Option {
+	return func(rl *rateLimiter) {
+		rl.maxDelay = maxDelay
+		rl.maxDelaySet = true
+	}
+}
+
+// HideClientHeaders stops the middleware from telling clients about their limit
+// with the RateLimit-* headers, like the hide_client_headers setting of Kong.
+// Retry-After is still set on rejections.
+func HideClientHeaders() Option {
+	return func(rl *rateLimiter) {
+		rl.hideHeaders = true
+	}
+}
+
+// DenyAll rejects every request, whatever the configured limits.
+func DenyAll() Option {
+	return func(rl *rateLimiter) {
+		rl.denyAll = true
+	}
 }
 
 // New returns a rate limiter middleware.
-func New(ctx context.Context, next http.Handler, config dynamic.RateLimit, name string) (http.Handler, error) {
+// An Average of 0 means no limit, but those of the tiers if any.
+func New(ctx context.Context, next http.Handler, config dynamic.RateLimit, name string, opts ...Option) (http.Handler, error) {
 	ctxLog := log.With(ctx, log.Str(log.MiddlewareName, name), log.Str(log.MiddlewareType, typeName))
 	log.FromContext(ctxLog).Debug("Creating middleware")
 
@@ -61,11 +201,6 @@ func New(ctx context.Context, next http.Handler, config dynamic.RateLimit, name
 		return nil, err
 	}
 
-	buckets, err := ttlmap.NewConcurrent(maxSources)
-	if err != nil {
-		return nil, err
-	}
-
 	burst := config.Burst
 	if burst < 1 {
 		burst = 1
@@ -79,20 +214,10 @@ func New(ctx context.Context, next http.Handler, config dynamic.RateLimit, name
 		period = time.Second
 	}
 
-	// if config.Average == 0, in that case,
-	// the value of maxDelay does not matter since the reservation will (buggily) give us a delay of 0 anyway.
-	var maxDelay time.Duration
+	// if config.Average == 0, in that case, there is no limit but those of the tiers, if any.
 	var rtl float64
 	if config.Average > 0 {
 		rtl = float64(config.Average*int64(time.Second)) / float64(period)
-		// maxDelay does not scale well for rates below 1,
-		// so we just cap it to the corresponding value, i.e. 0.5s, in order to keep the effective rate predictable.
-		// One alternative would be to switch to a no-reservation mode (Allow() method) whenever we are in such a low rate regime.
-		if rtl < 1 {
-			maxDelay = 500 * time.Millisecond
-		} else {
-			maxDelay = time.Second / (time.Duration(rtl) * 2)
-		}
 	}
 
 	// Make the ttl inversely proportional to how often a rate limiter is supposed to see any activity (when maxed out),
@@ -106,16 +231,101 @@ func New(ctx context.Context, next http.Handler, config dynamic.RateLimit, name
 		ttl += int(1 / rtl)
 	}
 
-	return &rateLimiter{
+	rl := &rateLimiter{
 		name:          name,
 		rate:          rate.Limit(rtl),
 		burst:         burst,
-		maxDelay:      maxDelay,
 		next:          next,
 		sourceMatcher: sourceMatcher,
-		buckets:       buckets,
 		ttl:           ttl,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(rl)
+	}
+
+	if rl.exemptionConfig != nil {
+		rl.exemptions, err = newExemptions(ctxLog, *rl.exemptionConfig)
+		if err != nil {
+			return nil, fmt.Errorf("exemptions: %w", err)
+		}
+	}
+
+	if rl.rejectionTemplate != nil {
+		if rl.renderer != nil {
+			return nil, errors.New("a rejection template and problem details are mutually exclusive")
+		}
+		rl.renderer, err = newTemplateRenderer(*rl.rejectionTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("rejection template: %w", err)
+		}
+	}
+
+	if len(rl.sourceParts) > 0 {
+		rl.sourceMatcher, err = compositeExtractor(ctxLog, rl.sourceParts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch rl.mode {
+	case ModeDelay, ModeReject, ModeQueue:
+	default:
+		return nil, fmt.Errorf("unknown mode: %d", rl.mode)
+	}
+	rl.maxDelay = rl.maxDelayFor(rtl, burst)
+	if rl.maxDelay < 0 {
+		return nil, fmt.Errorf("negative value not valid for maxDelay: %v", rl.maxDelay)
+	}
+
+	var policies []string
+	if config.Average > 0 {
+		rl.limits = append(rl.limits, Limit{Rate: rl.rate, Burst: burst, TTL: time.Duration(ttl) * time.Second})
+		policies = append(policies, policy(config.Average, period, burst))
+	}
+	for i, tier := range rl.tiers {
+		limit, err := tier.limit()
+		if err != nil {
+			return nil, fmt.Errorf("tier %d: %w", i, err)
+		}
+		rl.limits = append(rl.limits, limit)
+		policies = append(policies, policy(tier.Average, tier.period(), limit.Burst))
+	}
+	rl.policy = strings.Join(policies, ", ")
+
+	rl.maxAmount = math.MaxInt64
+	for _, limit := range rl.limits {
+		if limit.Burst < rl.maxAmount {
+			rl.maxAmount = limit.Burst
+		}
+	}
+
+	if rl.store == nil {
+		capacity := maxSources
+		if rl.capacitySet {
+			capacity = rl.capacity
+		}
+		store, err := newMemoryStore(capacity, rl.overflow)
+		if err != nil {
+			return nil, err
+		}
+		rl.store = store
+	} else if rl.capacitySet {
+		return nil, errors.New("capacity only applies to the default store")
+	}
+	rl.metrics.register(name, rl.store)
+
+	if err := rl.newRoutes(); err != nil {
+		return nil, err
+	}
+
+	for _, rt := range append(rl.routes, rl.defaultRoute) {
+		if rl.cost > rt.maxAmount {
+			return nil, fmt.Errorf("cost %d is larger than burst %d: no request would ever be allowed", rl.cost, rt.maxAmount)
+		}
+	}
+
+	return rl, nil
 }
 
 func (rl *rateLimiter) GetTracingInformation() (string, ext.SpanKindEnum) {
@@ -126,6 +336,34 @@ func (rl *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := middlewares.GetLoggerCtx(r.Context(), rl.name, typeName)
 	logger := log.FromContext(ctx)
 
+	if ok, reason := rl.exemptions.exempt(r); ok {
+		logger.Debugf("request bypasses the rate limiter: %s", reason)
+		rl.observe(r, outcomeBypassed, 0)
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+
+	dryRun := rl.dryRun.Enabled()
+
+	if rl.denyAll {
+		if dryRun {
+			rl.serveWouldReject(w, r, logger, "all requests are denied")
+			return
+		}
+		rl.observe(r, outcomeRejected, 0)
+		rl.serveDenyAll(ctx, w, r)
+		return
+	}
+
+	rt := rl.routeOf(r)
+
+	// No limit at all.
+	if len(rt.limits) == 0 {
+		rl.observe(r, outcomeAllowed, 0)
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+
 	source, amount, err := rl.sourceMatcher.Extract(r)
 	if err != nil {
 		logger.Errorf("could not extract source of request: %v", err)
@@ -133,53 +371,277 @@ func (rl *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if amount != 1 {
-		logger.Infof("ignoring token bucket amount > 1: %d", amount)
+	if rl.cost > 0 {
+		amount = rl.cost
+	}
+	if amount < 1 {
+		amount = 1
 	}
 
-	var bucket *rate.Limiter
-	if rlSource, exists := rl.buckets.Get(source); exists {
-		bucket = rlSource.(*rate.Limiter)
-	} else {
-		bucket = rate.NewLimiter(rl.rate, int(rl.burst))
+	key := rt.keyPrefix + source
+
+	// Such a request would never get a reservation, however long it waits.
+	if amount > rt.maxAmount {
+		rl.tagReservations(r, key, nil)
+		if dryRun {
+			rl.serveWouldReject(w, r, logger, fmt.Sprintf("request amount %d exceeds burst %d", amount, rt.maxAmount))
+			return
+		}
+		logger.Debugf("request amount %d exceeds burst %d", amount, rt.maxAmount)
+		rl.observe(r, outcomeRejected, 0)
+		detail := fmt.Sprintf("Request amount %d exceeds burst %d", amount, rt.maxAmount)
+		if rl.renderer == nil {
+			http.Error(w, detail, http.StatusTooManyRequests)
+			return
+		}
+		rl.serveRejection(ctx, w, r, rl.newRejection(r, detail, 0))
+		return
 	}
 
-	// We Set even in the case where the source already exists,
-	// because we want to update the expiryTime everytime we get the source,
-	// as the expiryTime is supposed to reflect the activity (or lack thereof) on that source.
-	if err := rl.buckets.Set(source, bucket, rl.ttl); err != nil {
-		logger.Errorf("could not insert/update bucket: %v", err)
-		http.Error(w, "could not insert/update bucket", http.StatusInternalServerError)
+	reservations, err := rl.store.Reserve(r.Context(), key, rt.limits, amount, time.Now(), rt.maxDelay)
+	if err != nil {
+		logger.Errorf("could not reserve tokens: %v", err)
+		http.Error(w, "could not reserve tokens", http.StatusInternalServerError)
 		return
 	}
 
-	// time/rate is bugged, since a rate.Limiter with a 0 Limit not only allows a Reservation to take place,
-	// but also gives a 0 delay below (because of a division by zero, followed by a multiplication that flips into the negatives),
-	// regardless of the current load.
-	// However, for now we take advantage of this behavior to provide the no-limit ratelimiter when config.Average is 0.
-	res := bucket.Reserve()
-	if !res.OK() {
-		http.Error(w, "No bursty traffic allowed", http.StatusTooManyRequests)
+	res := combine(reservations)
+	rl.tagReservations(r, key, reservations)
+
+	if dryRun {
+		switch {
+		case !res.OK:
+			rl.serveWouldReject(w, r, logger, fmt.Sprintf("rate limit exceeded, retry in %v", res.Delay))
+		case res.Delay > 0:
+			logger.Infof("dry run: would delay request by %v", res.Delay)
+			rl.observe(r, outcomeWouldDelay, 0)
+			rl.next.ServeHTTP(w, r)
+		default:
+			rl.observe(r, outcomeAllowed, 0)
+			rl.next.ServeHTTP(w, r)
+		}
+		return
+	}
+
+	rl.setRateLimitHeaders(w.Header(), rt, reservations)
+
+	if !res.OK {
+		rl.observe(r, outcomeRejected, 0)
+		rl.serveDelayError(ctx, w, r, res.Delay)
 		return
 	}
 
-	delay := res.Delay()
-	if delay > rl.maxDelay {
-		res.Cancel()
-		rl.serveDelayError(ctx, w, r, delay)
+	if !wait(r.Context(), res.Delay) {
+		// Give the tokens back to the requests queued behind this one.
+		if refunds, err := rl.store.Reserve(context.Background(), key, rt.limits, -amount, time.Now(), 0); err != nil {
+			logger.Errorf("could not return tokens: %v", err)
+		} else if !combine(refunds).OK {
+			logger.Errorf("could not return tokens: the store refused them")
+		}
+		logger.Debugf("request canceled while waiting for its tokens: %v", r.Context().Err())
+		rl.observe(r, outcomeCanceled, 0)
+		http.Error(w, "Client Closed Request", statusClientClosedRequest)
+		return
+	}
+
+	if res.Delay > 0 {
+		rl.observe(r, outcomeDelayed, res.Delay)
+	} else {
+		rl.observe(r, outcomeAllowed, 0)
+	}
+	rl.next.ServeHTTP(w, r)
+}
+
+// maxDelayFor returns how long a request may wait for the tokens of a bucket of rtl reqs/s and burst, in rl.mode.
+func (rl *rateLimiter) maxDelayFor(rtl float64, burst int64) time.Duration {
+	switch {
+	case rl.mode == ModeReject:
+		return 0
+	case rl.maxDelaySet:
+		return rl.maxDelay
+	case rtl <= 0:
+		// No limit but those of the tiers, if any,
+		// and the value of maxDelay does not matter when there are none: no reservation is made.
+		return 0
+	case rl.mode == ModeQueue:
+		return time.Duration(float64(burst) / rtl * float64(time.Second))
+	case rtl < 1:
+		// maxDelay does not scale well for rates below 1,
+		// so we just cap it to the corresponding value, i.e. 0.5s, in order to keep the effective rate predictable.
+		// One alternative would be to switch to a no-reservation mode (Allow() method) whenever we are in such a low rate regime.
+		return 500 * time.Millisecond
+	default:
+		return time.Second / (time.Duration(rtl) * 2)
+	}
+}
+
+// wait waits for delay, unless ctx is done first, when the client goes away.
+// A timer rather than time.Sleep so that such requests do not hold on to their goroutine.
+func wait(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// limit returns the Limit of the buckets of tier, with the defaults of dynamic.RateLimit.
+func (tier Tier) limit() (Limit, error) {
+	if tier.Average <= 0 {
+		return Limit{}, fmt.Errorf("average must be positive: %d", tier.Average)
+	}
+	if tier.Period < 0 {
+		return Limit{}, fmt.Errorf("negative value not valid for period: %v", tier.Period)
+	}
+
+	burst := tier.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	rtl := float64(tier.Average*int64(time.Second)) / float64(tier.period())
+
+	// As for the first tier, the ttl is about how long the bucket takes to give a token back.
+	ttl := 1
+	if rtl >= 1 {
+		ttl++
+	} else {
+		ttl += int(1 / rtl)
+	}
+
+	return Limit{Rate: rate.Limit(rtl), Burst: burst, TTL: time.Duration(ttl) * time.Second}, nil
+}
+
+func (tier Tier) period() time.Duration {
+	if tier.Period == 0 {
+		return time.Second
+	}
+	return tier.Period
+}
+
+// combine sums up the reservations of all the tiers: the request may proceed if they all are OK,
+// once the longest of their delays has elapsed.
+func combine(reservations []Reservation) Reservation {
+	res := Reservation{OK: true, Tokens: math.Inf(1)}
+	for _, r := range reservations {
+		res.OK = res.OK && r.OK
+		if r.Delay > res.Delay {
+			res.Delay = r.Delay
+		}
+		res.Tokens = math.Min(res.Tokens, r.Tokens)
+	}
+	return res
+}
+
+// policy describes the limit in the RateLimit-Policy header: average requests per window of w seconds,
+// e.g. "100;w=1;burst=200". The window is a whole number of seconds, so the average is scaled to it.
+func policy(average int64, period time.Duration, burst int64) string {
+	w := int64(math.Ceil(period.Seconds()))
+	if w < 1 {
+		w = 1
+	}
+	quota := int64(float64(average) * float64(w) * float64(time.Second) / float64(period))
+	return fmt.Sprintf("%d;w=%d;burst=%d", quota, w, burst)
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the IETF "RateLimit header fields for HTTP" draft,
+// the way the rate-limiting plugin of Kong does, from the state of the buckets of the request.
+// RateLimit-Limit is the burst, the most a client can send at once, of the most restrictive tier:
+// the one with the fewest requests left, or, among those, the one that takes the longest to refill.
+// RateLimit-Policy lists all the tiers.
+func (rl *rateLimiter) setRateLimitHeaders(h http.Header, rt *route, reservations []Reservation) {
+	if rl.hideHeaders {
 		return
 	}
 
-	time.Sleep(delay)
+	var limit Limit
+	remaining := int64(math.MaxInt64)
+	var reset time.Duration
+	for i, res := range reservations {
+		r := int64(math.Floor(res.Tokens))
+		if r < 0 {
+			r = 0
+		}
+		d := resetIn(rt.limits[i], res.Tokens)
+
+		if r < remaining || r == remaining && d > reset {
+			limit, remaining, reset = rt.limits[i], r, d
+		}
+	}
+
+	h.Set("RateLimit-Limit", strconv.FormatInt(limit.Burst, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("RateLimit-Reset", fmt.Sprintf("%.0f", math.Ceil(reset.Seconds())))
+	h.Set("RateLimit-Policy", rt.policy)
+}
+
+// resetIn returns how long a bucket holding tokens takes to be full again.
+func resetIn(limit Limit, tokens float64) time.Duration {
+	missing := float64(limit.Burst) - tokens
+	switch {
+	case missing <= 0:
+		return 0
+	case limit.Rate > 0:
+		return time.Duration(missing / float64(limit.Rate) * float64(time.Second))
+	default:
+		// Never refilled, but forgotten after its ttl.
+		return limit.TTL
+	}
+}
+
+// serveWouldReject lets through, in dry run, a request that would be rejected for reason.
+func (rl *rateLimiter) serveWouldReject(w http.ResponseWriter, r *http.Request, logger log.Logger, reason string) {
+	logger.Infof("dry run: would reject request: %s", reason)
+	rl.observe(r, outcomeWouldReject, 0)
 	rl.next.ServeHTTP(w, r)
 }
 
+// serveDenyAll rejects a request for good: there is no point in a Retry-After.
+func (rl *rateLimiter) serveDenyAll(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if !rl.hideHeaders {
+		w.Header().Set("RateLimit-Limit", "0")
+		w.Header().Set("RateLimit-Remaining", "0")
+		w.Header().Set("RateLimit-Policy", "0;w=1")
+	}
+	rl.serveRejection(ctx, w, r, rl.newRejection(r, "All requests are denied.", 0))
+}
+
 func (rl *rateLimiter) serveDelayError(ctx context.Context, w http.ResponseWriter, r *http.Request, delay time.Duration) {
 	w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(delay.Seconds())))
 	w.Header().Set("X-Retry-In", delay.String())
+
+	rejection := rl.newRejection(r, "", delay)
+	rejection.Detail = fmt.Sprintf("Rate limit exceeded, retry in %v.", time.Duration(rejection.RetryAfter)*time.Second)
+	rl.serveRejection(ctx, w, r, rejection)
+}
+
+// serveRejection writes a 429 with the renderer, or the plain text "Too Many Requests" if there is none,
+// or if it fails.
+func (rl *rateLimiter) serveRejection(ctx context.Context, w http.ResponseWriter, r *http.Request, rejection Rejection) {
+	body := []byte(http.StatusText(http.StatusTooManyRequests))
+	if rl.renderer != nil {
+		header, rendered, err := rl.renderer.render(r, rejection)
+		if err != nil {
+			log.FromContext(ctx).Errorf("could not render 429: %v", err)
+		} else {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			body = rendered
+		}
+	}
+
 	w.WriteHeader(http.StatusTooManyRequests)
 
-	if _, err := w.Write([]byte(http.StatusText(http.StatusTooManyRequests))); err != nil {
+	if _, err := w.Write(body); err != nil {
 		log.FromContext(ctx).Errorf("could not serve 429: %v", err)
 	}
 }
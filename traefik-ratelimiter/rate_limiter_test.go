@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +18,7 @@ import (
 	"github.com/traefik/traefik/v2/pkg/config/dynamic"
 	"github.com/traefik/traefik/v2/pkg/testhelpers"
 	"github.com/vulcand/oxy/utils"
+	"golang.org/x/time/rate"
 )
 
 func TestNewRateLimiter(t *testing.T) {
@@ -220,16 +224,15 @@ func TestRateLimit(t *testing.T) {
 			incomingLoad: 300,
 			burst:        0,
 		},
-		// TODO Try to disambiguate when it fails if it is because of too high a load.
-		// {
-		// 	desc: "Zero average ==> no rate limiting",
-		// 	config: dynamic.RateLimit{
-		// 		Average: 0,
-		// 		Burst:   1,
-		// 	},
-		// 	incomingLoad: 1000,
-		// 	loadDuration: time.Second,
-		// },
+		{
+			desc: "Zero average ==> no rate limiting",
+			config: dynamic.RateLimit{
+				Average: 0,
+				Burst:   1,
+			},
+			incomingLoad: 1000,
+			loadDuration: time.Second,
+		},
 	}
 
 	for _, test := range testCases {
@@ -242,6 +245,7 @@ func TestRateLimit(t *testing.T) {
 
 			reqCount := 0
 			dropped := 0
+			sent := 0
 			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				reqCount++
 			})
@@ -263,6 +267,7 @@ func TestRateLimit(t *testing.T) {
 				w := httptest.NewRecorder()
 
 				h.ServeHTTP(w, req)
+				sent++
 				if w.Result().StatusCode != http.StatusOK {
 					dropped++
 				}
@@ -287,8 +292,13 @@ func TestRateLimit(t *testing.T) {
 			}
 
 			if test.config.Average == 0 {
-				if reqCount < 75*test.incomingLoad/100 {
-					t.Fatalf("we (arbitrarily) expect at least 75%% of the requests to go through with no rate limiting, and yet only %d/%d went through", reqCount, test.incomingLoad)
+				// How many requests the ticker lets the test send depends on the load of the machine,
+				// hence the loose bound: requests delayed by the rate limiter would not even make it.
+				if sent < test.incomingLoad/2 {
+					t.Fatalf("requests should not be delayed with no rate limiting, and yet only %d/%d could be sent", sent, test.incomingLoad)
+				}
+				if reqCount != sent {
+					t.Fatalf("all the requests should go through with no rate limiting, and yet only %d/%d did", reqCount, sent)
 				}
 				if dropped != 0 {
 					t.Fatalf("no request should have been dropped if rate limiting is disabled, and yet %d were", dropped)
@@ -330,6 +340,597 @@ func computeMinCount(wantCount int) int {
 	return wantCount * 95 / 100
 }
 
+// costExtractor keys requests on their remote address, with the amount set by their X-Cost header.
+var costExtractor = utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+	cost, err := strconv.ParseInt(req.Header.Get("X-Cost"), 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return req.RemoteAddr, cost, nil
+})
+
+func newWeightedRateLimiter(t *testing.T, config dynamic.RateLimit, next http.Handler, opts ...Option) *rateLimiter {
+	t.Helper()
+
+	h, err := New(context.Background(), next, config, "rate-limiter", opts...)
+	require.NoError(t, err)
+
+	rtl := h.(*rateLimiter)
+	rtl.sourceMatcher = costExtractor
+	return rtl
+}
+
+func serveWithCost(h http.Handler, cost int64) *httptest.ResponseRecorder {
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Cost", strconv.FormatInt(cost, 10))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitAmount(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// 10 tokens per second, i.e. one every 100ms, and maxDelay is 50ms:
+	// no token comes back during the test.
+	h := newWeightedRateLimiter(t, dynamic.RateLimit{Average: 10, Burst: 10}, next)
+
+	steps := []struct {
+		cost     int64
+		expected int
+	}{
+		{cost: 4, expected: http.StatusOK},
+		{cost: 4, expected: http.StatusOK},
+		{cost: 4, expected: http.StatusTooManyRequests}, // 2 tokens left
+		{cost: 1, expected: http.StatusOK},
+		{cost: 1, expected: http.StatusOK},
+		{cost: 1, expected: http.StatusTooManyRequests},
+	}
+	for i, step := range steps {
+		w := serveWithCost(h, step.cost)
+		assert.Equal(t, step.expected, w.Code, "request %d with cost %d", i, step.cost)
+	}
+}
+
+func TestRateLimitAmountOverBurst(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := newWeightedRateLimiter(t, dynamic.RateLimit{Average: 10, Burst: 10}, next)
+
+	w := serveWithCost(h, 11)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "Request amount 11 exceeds burst 10\n", w.Body.String())
+	assert.Empty(t, w.Header().Get("Retry-After"), "retrying cannot help")
+
+	// The rejected request did not take any token.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	}
+}
+
+func TestRateLimitCost(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	h := newWeightedRateLimiter(t, dynamic.RateLimit{Average: 10, Burst: 10}, next, WithCost(5))
+
+	// The configured cost wins over the amount of the extractor.
+	assert.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	assert.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	assert.Equal(t, http.StatusTooManyRequests, serveWithCost(h, 1).Code)
+
+	_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 10}, "rate-limiter", WithCost(11))
+	assert.EqualError(t, err, "cost 11 is larger than burst 10: no request would ever be allowed")
+}
+
+// TestRateLimitMixedWeights sends requests of cost 1 and 3, and checks
+// that the tokens they reserved add up to the configured rate.
+func TestRateLimitMixedWeights(t *testing.T) {
+	config := dynamic.RateLimit{Average: 100, Burst: 10}
+	const (
+		loadDuration = 2 * time.Second
+		incomingLoad = 200 // in reqs/s
+	)
+
+	var tokens int64
+	costs := []int64{1, 3}
+	i := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cost, _ := strconv.ParseInt(r.Header.Get("X-Cost"), 10, 64)
+		tokens += cost
+	})
+	h := newWeightedRateLimiter(t, config, next)
+
+	ticker := time.NewTicker(time.Second / incomingLoad)
+	defer ticker.Stop()
+	start := time.Now()
+	for end := start.Add(loadDuration); time.Now().Before(end); i++ {
+		serveWithCost(h, costs[i%len(costs)])
+		<-ticker.C
+	}
+	elapsed := time.Since(start)
+
+	wantTokens := int(config.Average*int64(loadDuration/time.Second) + config.Burst)
+	maxTokens := wantTokens * 102 / 100
+	minTokens := computeMinCount(wantTokens)
+
+	if int(tokens) < minTokens {
+		t.Fatalf("rate was slower than expected: %d tokens (wanted > %d) in %v", tokens, minTokens, elapsed)
+	}
+	if int(tokens) > maxTokens {
+		t.Fatalf("rate was faster than expected: %d tokens (wanted < %d) in %v", tokens, maxTokens, elapsed)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		average  int64
+		period   time.Duration
+		burst    int64
+		expected string
+	}{
+		{desc: "per second", average: 100, period: time.Second, burst: 200, expected: "100;w=1;burst=200"},
+		{desc: "per minute", average: 5, period: time.Minute, burst: 1, expected: "5;w=60;burst=1"},
+		{desc: "period below 1 second", average: 50, period: 500 * time.Millisecond, burst: 1, expected: "100;w=1;burst=1"},
+		{desc: "period not a whole number of seconds", average: 3, period: 1500 * time.Millisecond, burst: 3, expected: "4;w=2;burst=3"},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, policy(test.average, test.period, test.burst))
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// One token every 100ms, and a maxDelay of 50ms: none comes back during the test.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 5}, "rate-limiter")
+	require.NoError(t, err)
+
+	for i := 4; i >= 0; i-- {
+		w := serveWithCost(h, 1)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, strconv.Itoa(i), w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+		assert.Equal(t, "10;w=1;burst=5", w.Header().Get("RateLimit-Policy"))
+		assert.Empty(t, w.Header().Get("Retry-After"))
+	}
+
+	w := serveWithCost(h, 1)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "10;w=1;burst=5", w.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+// TestRateLimitHeadersUnderLoad sends concurrent requests,
+// and checks that every allowed one was told a different number of remaining requests.
+func TestRateLimitHeadersUnderLoad(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	const burst = 50
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 1, Period: ptypes.Duration(time.Minute), Burst: burst}, "rate-limiter")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	remaining := map[string]int{}
+	rejected := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			w := serveWithCost(h, 1)
+
+			assert.Equal(t, "50", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, "1;w=60;burst=50", w.Header().Get("RateLimit-Policy"))
+			reset, err := strconv.Atoi(w.Header().Get("RateLimit-Reset"))
+			assert.NoError(t, err)
+			assert.True(t, reset > 0 && reset <= 60*burst, "RateLimit-Reset: %d", reset)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if w.Code == http.StatusOK {
+				remaining[w.Header().Get("RateLimit-Remaining")]++
+			} else {
+				rejected++
+				assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 3*burst, rejected)
+	require.Len(t, remaining, burst)
+	for i := 0; i < burst; i++ {
+		assert.Equal(t, 1, remaining[strconv.Itoa(i)], "RateLimit-Remaining: %d", i)
+	}
+}
+
+func TestRateLimitHideClientHeaders(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter", HideClientHeaders())
+	require.NoError(t, err)
+
+	w := serveWithCost(h, 1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithCost(h, 1)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	for _, header := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"} {
+		assert.Empty(t, w.Header().Get(header), header)
+	}
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+}
+
+func TestNewRateLimiterMode(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		opts             []Option
+		expectedMaxDelay time.Duration
+		expectedError    string
+	}{
+		{
+			desc:             "delay, default maxDelay",
+			expectedMaxDelay: 50 * time.Millisecond,
+		},
+		{
+			desc:             "delay, configured maxDelay",
+			opts:             []Option{WithMaxDelay(time.Second)},
+			expectedMaxDelay: time.Second,
+		},
+		{
+			desc:             "reject",
+			opts:             []Option{WithMode(ModeReject), WithMaxDelay(time.Second)},
+			expectedMaxDelay: 0,
+		},
+		{
+			desc:             "queue, as long as the bucket",
+			opts:             []Option{WithMode(ModeQueue)},
+			expectedMaxDelay: 2 * time.Second,
+		},
+		{
+			desc:             "queue, configured maxDelay",
+			opts:             []Option{WithMaxDelay(time.Second), WithMode(ModeQueue)},
+			expectedMaxDelay: time.Second,
+		},
+		{
+			desc:          "negative maxDelay",
+			opts:          []Option{WithMaxDelay(-time.Second)},
+			expectedError: "negative value not valid for maxDelay: -1s",
+		},
+		{
+			desc:          "unknown mode",
+			opts:          []Option{WithMode(42)},
+			expectedError: "unknown mode: 42",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 20}, "rate-limiter", test.opts...)
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedMaxDelay, h.(*rateLimiter).maxDelay)
+		})
+	}
+}
+
+func TestRateLimitModes(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		opts     []Option
+		expected []int
+	}{
+		{
+			// One token every 100ms, 50ms maxDelay.
+			desc:     "delay, default maxDelay",
+			expected: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			desc:     "delay, configured maxDelay",
+			opts:     []Option{WithMaxDelay(150 * time.Millisecond)},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			desc:     "reject",
+			opts:     []Option{WithMode(ModeReject), WithMaxDelay(150 * time.Millisecond)},
+			expected: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			// The queue holds one token's worth.
+			desc:     "queue",
+			opts:     []Option{WithMode(ModeQueue)},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter", test.opts...)
+			require.NoError(t, err)
+
+			// All at once: none of them can wait for the previous one to be done.
+			got := make([]int, len(test.expected))
+			var wg sync.WaitGroup
+			for i := range got {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					got[i] = serveWithCost(h, 1).Code
+				}(i)
+			}
+			wg.Wait()
+
+			sort.Ints(got)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+// TestRateLimitQueueOrder checks that queued requests go through in arrival order, one per token.
+func TestRateLimitQueueOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, r.Header.Get("X-Request"))
+	})
+
+	// One token every 50ms, and a queue of 4.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 20, Burst: 4}, "rate-limiter", WithMode(ModeQueue))
+	require.NoError(t, err)
+
+	// Spend the burst.
+	for i := 0; i < 4; i++ {
+		require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	}
+	order = nil
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			req.Header.Set("X-Request", strconv.Itoa(i))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			codes[i] = w.Code
+		}(i)
+
+		// Let the request take its place in the queue before sending the next one.
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+	assert.Equal(t, []string{"0", "1", "2", "3"}, order)
+	assert.True(t, elapsed >= 150*time.Millisecond, "the queue was served too fast: %v", elapsed)
+}
+
+// TestRateLimitClientGone checks that a request stops waiting when its client goes away,
+// and gives its tokens back to the ones behind it.
+func TestRateLimitClientGone(t *testing.T) {
+	called := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+
+	// One token every 100ms.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter", WithMaxDelay(time.Second))
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil).WithContext(ctx)
+	req.RemoteAddr = "127.0.0.1:1234"
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, statusClientClosedRequest, w.Code)
+	assert.Less(t, int64(time.Since(start)), int64(80*time.Millisecond), "the request kept waiting")
+	assert.Equal(t, 1, called)
+
+	// Without the refund, this one would wait for 2 tokens' worth, i.e. about 180ms.
+	start = time.Now()
+	require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	assert.Less(t, int64(time.Since(start)), int64(150*time.Millisecond), "the tokens were not given back")
+	assert.Equal(t, 2, called)
+}
+
+// TestRateLimitClientGoneQueued checks that a request that stops waiting gives its tokens back
+// even when another one is queued behind it, and the bucket is still in debt after the refund.
+func TestRateLimitClientGoneQueued(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// One token every 100ms.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter", WithMaxDelay(time.Second))
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+
+	// A waits for the next token, B for the one after.
+	ctx, cancel := context.WithCancel(context.Background())
+	reqA := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil).WithContext(ctx)
+	reqA.RemoteAddr = "127.0.0.1:1234"
+	codeA := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, reqA)
+		codeA <- w.Code
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	codeB := make(chan int)
+	go func() {
+		codeB <- serveWithCost(h, 1).Code
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	cancel()
+	assert.Equal(t, statusClientClosedRequest, <-codeA)
+
+	// With A's token back, C is third in line: about 180ms, instead of 280ms without the refund.
+	start := time.Now()
+	require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	assert.Less(t, int64(time.Since(start)), int64(240*time.Millisecond), "the tokens were not given back")
+	assert.Equal(t, http.StatusOK, <-codeB)
+}
+
+func TestNewRateLimiterTiers(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	config := dynamic.RateLimit{Average: 20, Burst: 40}
+
+	h, err := New(context.Background(), next, config, "rate-limiter", WithTiers(
+		Tier{Average: 1000, Period: time.Hour, Burst: 1000},
+		Tier{Average: 10, Period: 10 * time.Second},
+	))
+	require.NoError(t, err)
+
+	rtl := h.(*rateLimiter)
+	assert.Equal(t, []Limit{
+		{Rate: 20, Burst: 40, TTL: 2 * time.Second},
+		{Rate: rate.Limit(1000.0 / 3600), Burst: 1000, TTL: 4 * time.Second},
+		{Rate: 1, Burst: 1, TTL: 2 * time.Second},
+	}, rtl.limits)
+	assert.Equal(t, int64(1), rtl.maxAmount)
+	assert.Equal(t, "20;w=1;burst=40, 1000;w=3600;burst=1000, 10;w=10;burst=1", rtl.policy)
+
+	_, err = New(context.Background(), next, config, "rate-limiter", WithTiers(Tier{Period: time.Hour}))
+	assert.EqualError(t, err, "tier 0: average must be positive: 0")
+
+	_, err = New(context.Background(), next, config, "rate-limiter", WithTiers(Tier{Average: 1, Period: -time.Hour}))
+	assert.EqualError(t, err, "tier 0: negative value not valid for period: -1h0m0s")
+
+	_, err = New(context.Background(), next, config, "rate-limiter", WithTiers(Tier{Average: 10, Burst: 5}), WithCost(10))
+	assert.EqualError(t, err, "cost 10 is larger than burst 5: no request would ever be allowed")
+}
+
+// TestRateLimitTiers checks that a request takes its tokens from all the tiers or from none,
+// and that the headers report the most restrictive tier.
+func TestRateLimitTiers(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// 10/s with a burst of 5 (and a maxDelay of 50ms), and 6/min.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 5}, "rate-limiter",
+		WithTiers(Tier{Average: 6, Period: time.Minute, Burst: 6}))
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, serveWithCost(h, 1).Code)
+	}
+
+	// The first tier is empty, and has the fewest tokens left.
+	w := serveWithCost(h, 1)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "5", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "10;w=1;burst=5, 6;w=60;burst=6", w.Header().Get("RateLimit-Policy"))
+
+	// The rejected request did not take the last token of the second tier.
+	time.Sleep(200 * time.Millisecond)
+	w = serveWithCost(h, 1)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "6", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	reset, err := strconv.Atoi(w.Header().Get("RateLimit-Reset"))
+	require.NoError(t, err)
+	assert.InDelta(t, 59, reset, 1)
+
+	// The second tier is empty now.
+	w = serveWithCost(h, 1)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "6", w.Header().Get("RateLimit-Limit"))
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 10, retryAfter, 1)
+}
+
+func TestRateLimitUnlimited(t *testing.T) {
+	called := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 0, Burst: 1}, "rate-limiter")
+	require.NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		w := serveWithCost(h, 1)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("RateLimit-Limit"))
+	}
+	assert.Equal(t, 1000, called)
+
+	// With no Average, the tiers still apply.
+	h, err = New(context.Background(), next, dynamic.RateLimit{Average: 0, Burst: 1}, "rate-limiter",
+		WithTiers(Tier{Average: 1, Period: time.Minute, Burst: 2}))
+	require.NoError(t, err)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		codes = append(codes, serveWithCost(h, 1).Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestRateLimitDenyAll(t *testing.T) {
+	called := 0
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+
+	for _, config := range []dynamic.RateLimit{{Average: 100, Burst: 100}, {Average: 0}} {
+		h, err := New(context.Background(), next, config, "rate-limiter", DenyAll())
+		require.NoError(t, err)
+
+		w := serveWithCost(h, 1)
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Empty(t, w.Header().Get("Retry-After"))
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "0;w=1", w.Header().Get("RateLimit-Policy"))
+	}
+	assert.Equal(t, 0, called)
+}
+
 // Test TOKEN BUCKET Algorithm in Traefik API Gateway's middleware located in:
 // traefik/pkg/middlewares/ratelimiter
 // See README.md how token bucket works.
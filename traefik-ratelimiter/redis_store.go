@@ -0,0 +1,310 @@
+package ratelimiter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// redisTimeout bounds a round trip to Redis when the request context has no deadline.
+	redisTimeout = time.Second
+	// redisMaxIdle is the number of connections kept open between requests.
+	redisMaxIdle = 16
+)
+
+// reserveScript is take, run by Redis so that the check and the update of the buckets of a source are atomic.
+// Times are in microseconds, which a Lua number holds exactly.
+// KEYS are the buckets, one per limit, each a hash of the tokens it held at its last update.
+// ARGV is amount, now and maxDelay, then rate (tokens/s), burst and ttl (ms) for each bucket.
+// It returns {ok, delay (-1 if the tokens never come back), tokens left} for each bucket.
+const reserveScript = `
+local amount = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local max_delay = tonumber(ARGV[3])
+
+local all_ok = true
+local buckets = {}
+for i, key in ipairs(KEYS) do
+	local rate = tonumber(ARGV[3 * i + 1])
+	local burst = tonumber(ARGV[3 * i + 2])
+
+	local tokens = burst
+	local last = now
+	local bucket = redis.call("HMGET", key, "tokens", "last")
+	if bucket[1] then
+		tokens = tonumber(bucket[1])
+		last = tonumber(bucket[2])
+	end
+
+	if now > last then
+		tokens = math.min(burst, tokens + (now - last) * rate / 1e6)
+	end
+	local left = math.min(burst, tokens - amount)
+
+	local delay = 0
+	if left < 0 then
+		if rate > 0 then
+			delay = math.floor(-left * 1e6 / rate)
+		else
+			delay = -1
+		end
+	end
+
+	local ok = amount <= 0 or (amount <= burst and delay >= 0 and delay <= max_delay)
+	all_ok = all_ok and ok
+	buckets[i] = {ok = ok, delay = delay, tokens = tokens, left = left}
+end
+
+local reply = {}
+for i, key in ipairs(KEYS) do
+	local b = buckets[i]
+	local tokens = b.tokens
+	if all_ok then
+		tokens = b.left
+		-- tostring keeps 14 digits only: not enough for now.
+		redis.call("HSET", key, "tokens", tostring(tokens), "last", ARGV[2])
+		redis.call("PEXPIRE", key, ARGV[3 * i + 3])
+	end
+	reply[i] = {b.ok and 1 or 0, b.delay, tostring(tokens)}
+end
+return reply
+`
+
+var reserveScriptSHA = func() string {
+	sum := sha1.Sum([]byte(reserveScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisStore is a BucketStore kept in Redis, or in anything else that speaks its protocol (RESP) and runs its Lua scripts,
+// so that all the replicas of traefik draw from the same buckets.
+// The replicas pass their own time to Redis, so their clocks should be synchronized.
+type RedisStore struct {
+	addr   string
+	prefix string
+	dialer net.Dialer
+	idle   chan *redisConn
+}
+
+// NewRedisStore returns a BucketStore kept in the Redis server at addr.
+// The buckets are stored under prefix followed by the source: middlewares sharing a server need their own prefix.
+func NewRedisStore(addr, prefix string) *RedisStore {
+	return &RedisStore{
+		addr:   addr,
+		prefix: prefix,
+		idle:   make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+// Reserve runs reserveScript, loading it into Redis the first time around.
+// The buckets of a source share a hash tag, so that they live on the same node of a Redis Cluster.
+func (s *RedisStore) Reserve(ctx context.Context, key string, limits []Limit, amount int64, now time.Time, maxDelay time.Duration) ([]Reservation, error) {
+	args := []string{strconv.Itoa(len(limits))}
+	for i := range limits {
+		args = append(args, fmt.Sprintf("%s{%s}:%d", s.prefix, key, i))
+	}
+	args = append(args,
+		strconv.FormatInt(amount, 10),
+		strconv.FormatInt(now.UnixNano()/int64(time.Microsecond), 10),
+		strconv.FormatInt(int64(maxDelay/time.Microsecond), 10),
+	)
+	for _, limit := range limits {
+		args = append(args,
+			strconv.FormatFloat(float64(limit.Rate), 'g', -1, 64),
+			strconv.FormatInt(limit.Burst, 10),
+			strconv.FormatInt(int64(limit.TTL/time.Millisecond), 10),
+		)
+	}
+
+	reply, err := s.do(ctx, append([]string{"EVALSHA", reserveScriptSHA}, args...)...)
+	var redisErr redisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		reply, err = s.do(ctx, append([]string{"EVAL", reserveScript}, args...)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, ok := reply.([]interface{})
+	if !ok || len(buckets) != len(limits) {
+		return nil, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+
+	reservations := make([]Reservation, len(buckets))
+	for i, bucket := range buckets {
+		if reservations[i], err = parseReservation(bucket); err != nil {
+			return nil, err
+		}
+	}
+	return reservations, nil
+}
+
+// parseReservation parses the {ok, delay, tokens} of a bucket.
+func parseReservation(reply interface{}) (Reservation, error) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return Reservation{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	okFlag, ok1 := values[0].(int64)
+	delay, ok2 := values[1].(int64)
+	tokensStr, ok3 := values[2].(string)
+	if !ok1 || !ok2 || !ok3 {
+		return Reservation{}, fmt.Errorf("unexpected reply from redis: %v", reply)
+	}
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return Reservation{}, fmt.Errorf("unexpected reply from redis: %w", err)
+	}
+
+	res := Reservation{
+		OK:     okFlag == 1,
+		Delay:  time.Duration(delay) * time.Microsecond,
+		Tokens: tokens,
+	}
+	if delay < 0 {
+		res.Delay = rate.InfDuration
+	}
+	return res, nil
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			_ = c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a command and reads its reply, on an idle connection if there is one.
+// An error reply from Redis is returned as a redisError.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	var c *redisConn
+	select {
+	case c = <-s.idle:
+	default:
+		conn, err := s.dialer.DialContext(ctx, "tcp", s.addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	if err := c.SetDeadline(deadline); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	reply, err := c.do(args)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state.
+		_ = c.Close()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- c:
+	default:
+		_ = c.Close()
+	}
+	return reply, err
+}
+
+// redisError is an error reply of Redis, such as "NOSCRIPT No matching script".
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(args []string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readReply(c.r)
+}
+
+// readReply reads a RESP reply: a string, an int64, nil or a []interface{} of those.
+// An error reply is returned as a redisError, or as an element of the array it is part of.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply from redis: %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+
+	case '-':
+		return nil, redisError(value)
+
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = readReply(r)
+			var redisErr redisError
+			if errors.As(err, &redisErr) {
+				// Keep reading: the rest of the array is still on the wire.
+				values[i] = redisErr
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+
+	default:
+		return nil, fmt.Errorf("malformed reply from redis: %q", line)
+	}
+}
@@ -0,0 +1,253 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// Rejection describes a 429 response, for a RejectionTemplate to render.
+type Rejection struct {
+	Status int
+	Title  string
+	// Detail explains the rejection, e.g. "Rate limit exceeded, retry in 2 seconds."
+	Detail string
+	// RetryAfter is the number of seconds after which the request may be retried,
+	// or 0 if retrying it would not help.
+	RetryAfter int64
+	Middleware string
+	Method     string
+	Path       string
+}
+
+// RejectionTemplate configures the 429 responses of the rate limiter.
+// Body and the values of Headers are text/template templates, executed with a Rejection.
+// Besides the functions of text/template, they can use json, which encodes its argument as JSON, e.g.
+//
+//	{"error": {{json .Detail}}, "retry_in": {{.RetryAfter}}}
+type RejectionTemplate struct {
+	ContentType string
+	Body        string
+	Headers     map[string]string
+}
+
+// WithRejectionTemplate renders the 429 responses with template,
+// instead of the plain text "Too Many Requests".
+func WithRejectionTemplate(template RejectionTemplate) Option {
+	return func(rl *rateLimiter) {
+		rl.rejectionTemplate = &template
+	}
+}
+
+// WithProblemDetails renders the 429 responses as RFC 7807 problem details, of type typeURI,
+// to the clients that accept application/problem+json or application/json;
+// those that prefer text/plain get the detail of the problem in plain text.
+// The retry hint is the "retryAfter" member, in seconds.
+func WithProblemDetails(typeURI string) Option {
+	return func(rl *rateLimiter) {
+		rl.renderer = problemRenderer{typeURI: typeURI}
+	}
+}
+
+// renderer renders the 429 responses of the rate limiter: the headers to set, and the body.
+type renderer interface {
+	render(r *http.Request, rejection Rejection) (http.Header, []byte, error)
+}
+
+// newRejection describes a 429 response to r, one to be retried after delay, if positive.
+func (rl *rateLimiter) newRejection(r *http.Request, detail string, delay time.Duration) Rejection {
+	rejection := Rejection{
+		Status:     http.StatusTooManyRequests,
+		Title:      http.StatusText(http.StatusTooManyRequests),
+		Detail:     detail,
+		Middleware: rl.name,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+	}
+	if delay > 0 {
+		rejection.RetryAfter = int64(math.Ceil(delay.Seconds()))
+	}
+	return rejection
+}
+
+type templateRenderer struct {
+	contentType string
+	body        *template.Template
+	headers     map[string]*template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func newTemplateRenderer(config RejectionTemplate) (*templateRenderer, error) {
+	if config.ContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(config.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %w", config.ContentType, err)
+		}
+		if _, subtype := splitMediaType(mediaType); subtype == "" {
+			return nil, fmt.Errorf("invalid content type %q: no subtype", config.ContentType)
+		}
+	}
+
+	body, err := template.New("body").Funcs(templateFuncs).Parse(config.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string]*template.Template, len(config.Headers))
+	for name, value := range config.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		headers[name], err = template.New(name).Funcs(templateFuncs).Parse(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &templateRenderer{contentType: config.ContentType, body: body, headers: headers}, nil
+}
+
+func (t *templateRenderer) render(_ *http.Request, rejection Rejection) (http.Header, []byte, error) {
+	var body bytes.Buffer
+	if err := t.body.Execute(&body, rejection); err != nil {
+		return nil, nil, err
+	}
+
+	header := make(http.Header)
+	for name, tmpl := range t.headers {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, rejection); err != nil {
+			return nil, nil, err
+		}
+		if strings.ContainsAny(value.String(), "\r\n") {
+			return nil, nil, fmt.Errorf("value of header %s has a line break", name)
+		}
+		header.Set(name, value.String())
+	}
+	if t.contentType != "" {
+		header.Set("Content-Type", t.contentType)
+	}
+
+	return header, body.Bytes(), nil
+}
+
+type problemRenderer struct {
+	typeURI string
+}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type       string `json:"type,omitempty"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Instance   string `json:"instance,omitempty"`
+	RetryAfter int64  `json:"retryAfter,omitempty"`
+}
+
+func (p problemRenderer) render(r *http.Request, rejection Rejection) (http.Header, []byte, error) {
+	contentType := negotiate(r.Header.Values("Accept"), contentTypeProblem, "application/json", "text/plain")
+
+	var body []byte
+	if contentType == "text/plain" {
+		body = []byte(rejection.Detail + "\n")
+		contentType = "text/plain; charset=utf-8"
+	} else {
+		var err error
+		body, err = json.Marshal(problem{
+			Type:       p.typeURI,
+			Title:      rejection.Title,
+			Status:     rejection.Status,
+			Detail:     rejection.Detail,
+			Instance:   rejection.Path,
+			RetryAfter: rejection.RetryAfter,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	return header, body, nil
+}
+
+// negotiate returns the one of offers that the Accept header values prefer,
+// the first of them on a tie, or when nothing is acceptable: a 429 is better than a 406.
+func negotiate(accept []string, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if len(accept) == 0 {
+		return offers[0]
+	}
+	return best
+}
+
+// acceptQuality returns the quality the Accept header values give to mediaType,
+// from the most specific of the ranges that match it.
+func acceptQuality(accept []string, mediaType string) float64 {
+	typ, subtype := splitMediaType(mediaType)
+
+	q, specificity := 0.0, -1
+	for _, value := range accept {
+		for _, element := range strings.Split(value, ",") {
+			rng, params, err := mime.ParseMediaType(strings.TrimSpace(element))
+			if err != nil {
+				continue
+			}
+			rngType, rngSubtype := splitMediaType(rng)
+
+			var s int
+			switch {
+			case rngType == typ && rngSubtype == subtype:
+				s = 2
+			case rngType == typ && rngSubtype == "*":
+				s = 1
+			case rngType == "*" && rngSubtype == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s <= specificity {
+				continue
+			}
+
+			specificity = s
+			q = 1
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					q = 0
+				}
+			}
+		}
+	}
+	return q
+}
+
+func splitMediaType(mediaType string) (string, string) {
+	parts := strings.SplitN(mediaType, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
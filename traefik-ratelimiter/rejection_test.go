@@ -0,0 +1,187 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{contentTypeProblem, "application/json", "text/plain"}
+
+	testCases := []struct {
+		accept   []string
+		expected string
+	}{
+		{accept: nil, expected: contentTypeProblem},
+		{accept: []string{"*/*"}, expected: contentTypeProblem},
+		{accept: []string{"application/problem+json"}, expected: contentTypeProblem},
+		{accept: []string{"application/json"}, expected: "application/json"},
+		{accept: []string{"application/*"}, expected: contentTypeProblem},
+		{accept: []string{"text/plain"}, expected: "text/plain"},
+		{accept: []string{"text/html, text/plain;q=0.5"}, expected: "text/plain"},
+		{accept: []string{"application/json;q=0.5, text/plain"}, expected: "text/plain"},
+		{accept: []string{"application/json", "text/plain;q=0.9"}, expected: "application/json"},
+		{accept: []string{"*/*;q=0.1, application/problem+json;q=0"}, expected: "application/json"},
+		{accept: []string{"image/png"}, expected: contentTypeProblem},
+		{accept: []string{"garbage;;;"}, expected: contentTypeProblem},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, negotiate(test.accept, offers...), "%v", test.accept)
+	}
+}
+
+func serveRejected(t *testing.T, h http.Handler, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost/users/1", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+	}
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	return w
+}
+
+func TestRateLimitProblemDetails(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// One token every 100ms and a maxDelay of 50ms: the second request is rejected, and retries in 1s.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithProblemDetails("https://example.com/problems/rate-limited"))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		accept       string
+		contentType  string
+		expectedBody string
+	}{
+		{
+			accept:       "",
+			contentType:  contentTypeProblem,
+			expectedBody: `{"type":"https://example.com/problems/rate-limited","title":"Too Many Requests","status":429,"detail":"Rate limit exceeded, retry in 1s.","instance":"/users/1","retryAfter":1}`,
+		},
+		{
+			accept:       "application/json",
+			contentType:  "application/json",
+			expectedBody: `{"type":"https://example.com/problems/rate-limited","title":"Too Many Requests","status":429,"detail":"Rate limit exceeded, retry in 1s.","instance":"/users/1","retryAfter":1}`,
+		},
+		{
+			accept:       "text/plain",
+			contentType:  "text/plain; charset=utf-8",
+			expectedBody: "Rate limit exceeded, retry in 1s.\n",
+		},
+	}
+
+	for _, test := range testCases {
+		w := serveRejected(t, h, test.accept)
+		assert.Equal(t, test.contentType, w.Header().Get("Content-Type"), test.accept)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), test.accept)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"), test.accept)
+		assert.Equal(t, test.expectedBody, w.Body.String(), test.accept)
+	}
+}
+
+func TestRateLimitProblemDetailsDenyAll(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := New(context.Background(), next, dynamic.RateLimit{}, "rate-limiter", DenyAll(), WithProblemDetails(""))
+	require.NoError(t, err)
+
+	w := serveRejected(t, h, "")
+	assert.Equal(t, `{"title":"Too Many Requests","status":429,"detail":"All requests are denied.","instance":"/users/1"}`, w.Body.String())
+}
+
+func TestRateLimitRejectionTemplate(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithRejectionTemplate(RejectionTemplate{
+			ContentType: "application/vnd.example+json",
+			Body:        `{"error": {{json .Detail}}, "route": {{json .Path}}, "retry_in": {{.RetryAfter}}}`,
+			Headers: map[string]string{
+				"X-Rate-Limited-By": "{{.Middleware}}",
+				"X-Retry-Seconds":   "{{.RetryAfter}}",
+			},
+		}))
+	require.NoError(t, err)
+
+	w := serveRejected(t, h, "")
+	assert.Equal(t, "application/vnd.example+json", w.Header().Get("Content-Type"))
+	assert.Equal(t, "rate-limiter", w.Header().Get("X-Rate-Limited-By"))
+	assert.Equal(t, "1", w.Header().Get("X-Retry-Seconds"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, `{"error": "Rate limit exceeded, retry in 1s.", "route": "/users/1", "retry_in": 1}`, w.Body.String())
+}
+
+func TestRateLimitRejectionTemplateFailure(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithRejectionTemplate(RejectionTemplate{
+			ContentType: "application/json",
+			Body:        `{"error": {{.Missing}}}`,
+			Headers:     map[string]string{"X-Detail": "{{.Detail}}"},
+		}))
+	require.NoError(t, err)
+
+	w := serveRejected(t, h, "")
+	assert.Empty(t, w.Header().Get("X-Detail"))
+	assert.Equal(t, "Too Many Requests", w.Body.String())
+}
+
+func TestNewRateLimiterRejection(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		opts          []Option
+		expectedError string
+	}{
+		{
+			desc:          "invalid body",
+			opts:          []Option{WithRejectionTemplate(RejectionTemplate{Body: "{{.Detail"})},
+			expectedError: "rejection template: template: body:1: unclosed action",
+		},
+		{
+			desc:          "invalid header",
+			opts:          []Option{WithRejectionTemplate(RejectionTemplate{Headers: map[string]string{"X-Detail": "{{end}}"}})},
+			expectedError: "rejection template: template: X-Detail:1: unexpected {{end}}",
+		},
+		{
+			desc:          "invalid header name",
+			opts:          []Option{WithRejectionTemplate(RejectionTemplate{Headers: map[string]string{"X Detail": "{{.Detail}}"}})},
+			expectedError: `rejection template: invalid header name "X Detail"`,
+		},
+		{
+			desc:          "invalid content type",
+			opts:          []Option{WithRejectionTemplate(RejectionTemplate{ContentType: "json"})},
+			expectedError: `rejection template: invalid content type "json": no subtype`,
+		},
+		{
+			desc:          "template and problem details",
+			opts:          []Option{WithProblemDetails(""), WithRejectionTemplate(RejectionTemplate{Body: "{{.Detail}}"})},
+			expectedError: "a rejection template and problem details are mutually exclusive",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10}, "rate-limiter", test.opts...)
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package ratelimiter
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route overrides the limits of dynamic.RateLimit, tiers included, for some of the requests,
+// e.g. 5 requests per minute on /login, and 50 per second on /search.
+// Its Average, Period and Burst mean the same as those of dynamic.RateLimit:
+// an Average of 0 lets the requests of the route through.
+type Route struct {
+	// PathPrefix selects the requests whose path starts with it, segment by segment:
+	// /login selects /login and /login/sso, but not /loginx.
+	PathPrefix string
+	// PathPattern selects the requests whose path matches it, as the PathTemplates of SourcePart do.
+	PathPattern string
+	Average     int64
+	Period      time.Duration
+	Burst       int64
+}
+
+// WithRoutes applies the limits of the first of routes that selects a request,
+// or those of dynamic.RateLimit if none does.
+// The routes share the source of a request, and the store of its buckets, but each has buckets of its own.
+func WithRoutes(routes ...Route) Option {
+	return func(rl *rateLimiter) {
+		rl.routeConfigs = append(rl.routeConfigs, routes...)
+	}
+}
+
+// route is the set of limits applied to a request: those of a Route, or the default ones.
+type route struct {
+	pathPrefix string
+	pattern    []string
+	// keyPrefix is prepended to the source of a request to make the key of its buckets,
+	// so that the routes do not share them.
+	keyPrefix string
+	limits    []Limit
+	// maxAmount is the smallest burst of limits: a request may not reserve more.
+	maxAmount int64
+	maxDelay  time.Duration
+	// policy is the value of the RateLimit-Policy header.
+	policy string
+}
+
+func (rl *rateLimiter) newRoute(config Route) (*route, error) {
+	rt := &route{maxAmount: math.MaxInt64}
+
+	switch {
+	case config.PathPrefix != "" && config.PathPattern != "":
+		return nil, errors.New("PathPrefix and PathPattern are mutually exclusive")
+	case config.PathPrefix != "":
+		if !strings.HasPrefix(config.PathPrefix, "/") {
+			return nil, fmt.Errorf("path prefix %q does not start with /", config.PathPrefix)
+		}
+		rt.pathPrefix = config.PathPrefix
+	case config.PathPattern != "":
+		pattern, err := parsePathTemplate(config.PathPattern)
+		if err != nil {
+			return nil, err
+		}
+		rt.pattern = pattern
+	default:
+		return nil, errors.New("one of PathPrefix or PathPattern must be set")
+	}
+
+	if config.Average < 0 {
+		return nil, fmt.Errorf("negative value not valid for average: %d", config.Average)
+	}
+	if config.Average == 0 {
+		return rt, nil
+	}
+
+	tier := Tier{Average: config.Average, Period: config.Period, Burst: config.Burst}
+	limit, err := tier.limit()
+	if err != nil {
+		return nil, err
+	}
+	rt.limits = []Limit{limit}
+	rt.maxAmount = limit.Burst
+	rt.maxDelay = rl.maxDelayFor(float64(limit.Rate), limit.Burst)
+	rt.policy = policy(tier.Average, tier.period(), limit.Burst)
+	return rt, nil
+}
+
+// matches tells whether the request with path is one of rt.
+func (rt *route) matches(path string) bool {
+	if rt.pattern != nil {
+		return matchPath(rt.pattern, splitPath(path))
+	}
+	prefix := strings.TrimSuffix(rt.pathPrefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// routeOf returns the route of r: the first that matches it, or the default one.
+func (rl *rateLimiter) routeOf(r *http.Request) *route {
+	for _, rt := range rl.routes {
+		if rt.matches(r.URL.Path) {
+			return rt
+		}
+	}
+	return rl.defaultRoute
+}
+
+// newRoutes sets up the routes of rl, and the default one from its own limits.
+func (rl *rateLimiter) newRoutes() error {
+	for i, config := range rl.routeConfigs {
+		rt, err := rl.newRoute(config)
+		if err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		rt.keyPrefix = strconv.Itoa(i) + ":"
+		rl.routes = append(rl.routes, rt)
+	}
+
+	rl.defaultRoute = &route{
+		limits:    rl.limits,
+		maxAmount: rl.maxAmount,
+		maxDelay:  rl.maxDelay,
+		policy:    rl.policy,
+	}
+	if len(rl.routes) > 0 {
+		rl.defaultRoute.keyPrefix = strconv.Itoa(len(rl.routes)) + ":"
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestRouteMatches(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		route    Route
+		path     string
+		expected bool
+	}{
+		{desc: "prefix, same path", route: Route{PathPrefix: "/login"}, path: "/login", expected: true},
+		{desc: "prefix, sub path", route: Route{PathPrefix: "/login"}, path: "/login/sso", expected: true},
+		{desc: "prefix, longer segment", route: Route{PathPrefix: "/login"}, path: "/loginx"},
+		{desc: "prefix, other path", route: Route{PathPrefix: "/login"}, path: "/search"},
+		{desc: "prefix with a trailing slash", route: Route{PathPrefix: "/api/"}, path: "/api/users", expected: true},
+		{desc: "root prefix", route: Route{PathPrefix: "/"}, path: "/anything", expected: true},
+		{desc: "pattern", route: Route{PathPattern: "/users/{id}/orders"}, path: "/users/42/orders", expected: true},
+		{desc: "pattern, longer path", route: Route{PathPattern: "/users/{id}/orders"}, path: "/users/42/orders/1"},
+		{desc: "pattern, shorter path", route: Route{PathPattern: "/users/{id}/orders"}, path: "/users/42"},
+		{desc: "pattern, empty segment", route: Route{PathPattern: "/users/{id}"}, path: "/users/"},
+		{desc: "pattern with a wildcard", route: Route{PathPattern: "/files/*"}, path: "/files/a/b", expected: true},
+	}
+
+	rl := &rateLimiter{}
+	for _, test := range testCases {
+		rt, err := rl.newRoute(test.route)
+		require.NoError(t, err, test.desc)
+		assert.Equal(t, test.expected, rt.matches(test.path), test.desc)
+	}
+}
+
+func TestNewRateLimiterRoutes(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		routes        []Route
+		cost          int64
+		expectedError string
+	}{
+		{
+			desc: "valid routes",
+			routes: []Route{
+				{PathPrefix: "/login", Average: 5, Period: time.Minute},
+				{PathPattern: "/users/{id}", Average: 50, Burst: 100},
+				{PathPrefix: "/health"},
+			},
+		},
+		{
+			desc:          "no path",
+			routes:        []Route{{Average: 5}},
+			expectedError: "route 0: one of PathPrefix or PathPattern must be set",
+		},
+		{
+			desc:          "both paths",
+			routes:        []Route{{PathPrefix: "/login"}, {PathPrefix: "/users", PathPattern: "/users/{id}"}},
+			expectedError: "route 1: PathPrefix and PathPattern are mutually exclusive",
+		},
+		{
+			desc:          "relative prefix",
+			routes:        []Route{{PathPrefix: "login"}},
+			expectedError: `route 0: path prefix "login" does not start with /`,
+		},
+		{
+			desc:          "invalid pattern",
+			routes:        []Route{{PathPattern: "/users/{id"}},
+			expectedError: `route 0: path template "/users/{id": invalid segment "{id"`,
+		},
+		{
+			desc:          "negative average",
+			routes:        []Route{{PathPrefix: "/login", Average: -1}},
+			expectedError: "route 0: negative value not valid for average: -1",
+		},
+		{
+			desc:          "negative period",
+			routes:        []Route{{PathPrefix: "/login", Average: 1, Period: -time.Second}},
+			expectedError: "route 0: negative value not valid for period: -1s",
+		},
+		{
+			desc:          "cost over the burst of a route",
+			routes:        []Route{{PathPrefix: "/login", Average: 5, Burst: 2}},
+			cost:          3,
+			expectedError: "cost 3 is larger than burst 2: no request would ever be allowed",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 10}, "rate-limiter",
+				WithRoutes(test.routes...), WithCost(test.cost))
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRateLimitRoutesFirstMatch(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithRoutes(
+			Route{PathPrefix: "/api/admin", Average: 1, Period: time.Minute},
+			Route{PathPrefix: "/api", Average: 100, Burst: 200},
+			Route{PathPattern: "/api/admin/{id}", Average: 1000},
+		))
+	require.NoError(t, err)
+	rl := h.(*rateLimiter)
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/api/admin/42", expected: "1;w=60;burst=1"},
+		{path: "/api/users", expected: "100;w=1;burst=200"},
+		{path: "/apis", expected: "10;w=1;burst=1"},
+		{path: "/", expected: "10;w=1;burst=1"},
+	}
+
+	for _, test := range testCases {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost"+test.path, nil)
+		assert.Equal(t, test.expected, rl.routeOf(req).policy, test.path)
+	}
+}
+
+// TestRateLimitRoutes checks that each route has buckets of its own,
+// keyed by the same source.
+func TestRateLimitRoutes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// None of the buckets gets a token back during the test.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithRoutes(
+			Route{PathPrefix: "/login", Average: 5, Period: time.Minute, Burst: 2},
+			Route{PathPrefix: "/search", Average: 50, Burst: 3},
+			Route{PathPrefix: "/health"},
+		))
+	require.NoError(t, err)
+
+	serve := func(remoteAddr, path string) *httptest.ResponseRecorder {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost"+path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// The login route lets 2 requests through, whatever their path under /login.
+	w := serve("127.0.0.1:1234", "/login")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "5;w=60;burst=2", w.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, http.StatusOK, serve("127.0.0.1:1234", "/login/sso").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("127.0.0.1:1234", "/login").Code)
+
+	// The search route has its own bucket.
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve("127.0.0.1:1234", "/search").Code)
+	}
+	w = serve("127.0.0.1:1234", "/search")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "50;w=1;burst=3", w.Header().Get("RateLimit-Policy"))
+
+	// So has the default one.
+	w = serve("127.0.0.1:1234", "/")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "10;w=1;burst=1", w.Header().Get("RateLimit-Policy"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("127.0.0.1:1234", "/loginx").Code)
+
+	// The health route is not limited.
+	for i := 0; i < 5; i++ {
+		w = serve("127.0.0.1:1234", "/health")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("RateLimit-Policy"))
+	}
+
+	// Another client has buckets of its own too.
+	assert.Equal(t, http.StatusOK, serve("127.0.0.2:1234", "/login").Code)
+	assert.Equal(t, http.StatusOK, serve("127.0.0.2:1234", "/search").Code)
+	assert.Equal(t, http.StatusOK, serve("127.0.0.2:1234", "/").Code)
+}
@@ -0,0 +1,191 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/middlewares"
+	"github.com/vulcand/oxy/utils"
+)
+
+// SourcePart is a component of a composite source, such as the API key or the route of a request.
+// As with dynamic.SourceCriterion, exactly one of its fields must be set.
+type SourcePart struct {
+	IPStrategy        *dynamic.IPStrategy
+	RequestHeaderName string
+	RequestHost       bool
+	// PathTemplates are route patterns such as "/users/{id}/orders": the component is the first one the path matches,
+	// so that /users/1/orders and /users/2/orders share their buckets.
+	// {name} matches one path segment, and a final * the rest of the path.
+	PathTemplates []string
+	// QueryParameter is the name of a query parameter whose value is the component.
+	QueryParameter string
+	// UserAgentClass makes the class of the User-Agent of the request the component:
+	// "bot", "script", "mobile", "browser", "other", or "none" without one.
+	UserAgentClass bool
+}
+
+// WithSourceCriteria keys the buckets on several components of the request at once,
+// e.g. the API key and the route, or the client IP and the class of its User-Agent.
+// It replaces the SourceCriterion of dynamic.RateLimit.
+// A component the request lacks, such as an API key, is empty:
+// all the requests without it share their buckets, as they do with a RequestHeaderName alone.
+func WithSourceCriteria(parts ...SourcePart) Option {
+	return func(rl *rateLimiter) {
+		rl.sourceParts = append(rl.sourceParts, parts...)
+	}
+}
+
+// compositeExtractor returns the SourceExtractor of parts.
+// The components are escaped and joined with "|", so that no two different sets of them make the same source.
+func compositeExtractor(ctx context.Context, parts []SourcePart) (utils.SourceExtractor, error) {
+	extractors := make([]func(*http.Request) (string, error), len(parts))
+	for i, part := range parts {
+		extract, err := part.extractor(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("source part %d: %w", i, err)
+		}
+		extractors[i] = extract
+	}
+
+	return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+		components := make([]string, len(extractors))
+		for i, extract := range extractors {
+			component, err := extract(req)
+			if err != nil {
+				return "", 0, err
+			}
+			components[i] = url.QueryEscape(component)
+		}
+		return strings.Join(components, "|"), 1, nil
+	}), nil
+}
+
+func (p SourcePart) extractor(ctx context.Context) (func(*http.Request) (string, error), error) {
+	set := 0
+	for _, isSet := range []bool{
+		p.IPStrategy != nil, p.RequestHeaderName != "", p.RequestHost,
+		len(p.PathTemplates) > 0, p.QueryParameter != "", p.UserAgentClass,
+	} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("exactly one of IPStrategy, RequestHeaderName, RequestHost, PathTemplates, QueryParameter or UserAgentClass must be set")
+	}
+
+	switch {
+	case p.IPStrategy != nil, p.RequestHeaderName != "", p.RequestHost:
+		extractor, err := middlewares.GetSourceExtractor(ctx, &dynamic.SourceCriterion{
+			IPStrategy:        p.IPStrategy,
+			RequestHeaderName: p.RequestHeaderName,
+			RequestHost:       p.RequestHost,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(req *http.Request) (string, error) {
+			source, _, err := extractor.Extract(req)
+			return source, err
+		}, nil
+
+	case len(p.PathTemplates) > 0:
+		templates := make([][]string, len(p.PathTemplates))
+		for i, template := range p.PathTemplates {
+			segments, err := parsePathTemplate(template)
+			if err != nil {
+				return nil, err
+			}
+			templates[i] = segments
+		}
+		return func(req *http.Request) (string, error) {
+			path := splitPath(req.URL.Path)
+			for i, template := range templates {
+				if matchPath(template, path) {
+					return p.PathTemplates[i], nil
+				}
+			}
+			return "", nil
+		}, nil
+
+	case p.QueryParameter != "":
+		return func(req *http.Request) (string, error) {
+			return req.URL.Query().Get(p.QueryParameter), nil
+		}, nil
+
+	default:
+		return func(req *http.Request) (string, error) {
+			return userAgentClass(req.UserAgent()), nil
+		}, nil
+	}
+}
+
+func parsePathTemplate(template string) ([]string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template %q does not start with /", template)
+	}
+
+	segments := splitPath(template)
+	for i, segment := range segments {
+		if segment == "*" && i != len(segments)-1 {
+			return nil, fmt.Errorf("path template %q: * must be the last segment", template)
+		}
+		if strings.ContainsAny(segment, "{}") && (!strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") || len(segment) < 3) {
+			return nil, fmt.Errorf("path template %q: invalid segment %q", template, segment)
+		}
+	}
+	return segments, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// matchPath tells whether the segments of a path match those of a template.
+func matchPath(template, path []string) bool {
+	for i, segment := range template {
+		if segment == "*" {
+			return true
+		}
+		if i >= len(path) {
+			return false
+		}
+		if strings.HasPrefix(segment, "{") {
+			if path[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != path[i] {
+			return false
+		}
+	}
+	return len(template) == len(path)
+}
+
+// userAgentClass sorts User-Agents into a few broad classes,
+// so that a client cannot get a bucket of its own by changing its User-Agent.
+func userAgentClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "none"
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "crawler"), strings.Contains(ua, "spider"):
+		return "bot"
+	case strings.HasPrefix(ua, "curl/"), strings.HasPrefix(ua, "wget/"), strings.HasPrefix(ua, "go-http-client/"),
+		strings.HasPrefix(ua, "python-"), strings.HasPrefix(ua, "okhttp/"), strings.HasPrefix(ua, "java/"):
+		return "script"
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "android"):
+		return "mobile"
+	case strings.HasPrefix(ua, "mozilla/"):
+		return "browser"
+	default:
+		return "other"
+	}
+}
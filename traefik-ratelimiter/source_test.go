@@ -0,0 +1,224 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestCompositeSource(t *testing.T) {
+	apiKey := SourcePart{RequestHeaderName: "X-Api-Key"}
+	route := SourcePart{PathTemplates: []string{"/users/{id}/orders", "/users/{id}", "/files/*"}}
+	ip := SourcePart{IPStrategy: &dynamic.IPStrategy{}}
+	uaClass := SourcePart{UserAgentClass: true}
+	tenant := SourcePart{QueryParameter: "tenant"}
+	host := SourcePart{RequestHost: true}
+
+	testCases := []struct {
+		desc     string
+		parts    []SourcePart
+		url      string
+		headers  map[string]string
+		expected string
+	}{
+		{
+			desc:     "API key and route",
+			parts:    []SourcePart{apiKey, route},
+			url:      "http://localhost/users/42/orders",
+			headers:  map[string]string{"X-Api-Key": "secret"},
+			expected: "secret|%2Fusers%2F%7Bid%7D%2Forders",
+		},
+		{
+			desc:     "API key and route, without an API key",
+			parts:    []SourcePart{apiKey, route},
+			url:      "http://localhost/users/42",
+			expected: "|%2Fusers%2F%7Bid%7D",
+		},
+		{
+			desc:     "API key and route, outside of the routes",
+			parts:    []SourcePart{apiKey, route},
+			url:      "http://localhost/health",
+			headers:  map[string]string{"X-Api-Key": "secret"},
+			expected: "secret|",
+		},
+		{
+			desc:     "route with a wildcard",
+			parts:    []SourcePart{route},
+			url:      "http://localhost/files/a/b/c.txt",
+			expected: "%2Ffiles%2F%2A",
+		},
+		{
+			desc:     "IP and User-Agent class",
+			parts:    []SourcePart{ip, uaClass},
+			url:      "http://localhost/",
+			headers:  map[string]string{"User-Agent": "curl/7.79.1"},
+			expected: "127.0.0.1|script",
+		},
+		{
+			desc:     "IP and User-Agent class, without a User-Agent",
+			parts:    []SourcePart{ip, uaClass},
+			url:      "http://localhost/",
+			expected: "127.0.0.1|none",
+		},
+		{
+			desc:     "query parameter and host",
+			parts:    []SourcePart{tenant, host},
+			url:      "http://example.com/?tenant=acme",
+			expected: "acme|example.com",
+		},
+		{
+			desc:     "query parameter and host, without the parameter",
+			parts:    []SourcePart{tenant, host},
+			url:      "http://example.com/?other=acme",
+			expected: "|example.com",
+		},
+		{
+			desc:     "components with the separator in them",
+			parts:    []SourcePart{apiKey, tenant},
+			url:      "http://localhost/?tenant=b%7Cc",
+			headers:  map[string]string{"X-Api-Key": "a"},
+			expected: "a|b%7Cc",
+		},
+		{
+			desc:     "all of them",
+			parts:    []SourcePart{ip, apiKey, route, tenant, uaClass, host},
+			url:      "http://example.com/users/1?tenant=acme",
+			headers:  map[string]string{"X-Api-Key": "secret", "User-Agent": "Googlebot/2.1"},
+			expected: "127.0.0.1|secret|%2Fusers%2F%7Bid%7D|acme|bot|example.com",
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			extractor, err := compositeExtractor(context.Background(), test.parts)
+			require.NoError(t, err)
+
+			req := testhelpers.MustNewRequest(http.MethodGet, test.url, nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+
+			source, amount, err := extractor.Extract(req)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, source)
+			assert.Equal(t, int64(1), amount)
+		})
+	}
+}
+
+func TestUserAgentClass(t *testing.T) {
+	testCases := []struct {
+		userAgent string
+		class     string
+	}{
+		{userAgent: "", class: "none"},
+		{userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", class: "bot"},
+		{userAgent: "Mozilla/5.0 (compatible; YandexSpider/3.0)", class: "bot"},
+		{userAgent: "curl/7.79.1", class: "script"},
+		{userAgent: "python-requests/2.28.1", class: "script"},
+		{userAgent: "Go-http-client/1.1", class: "script"},
+		{userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 15_6 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148", class: "mobile"},
+		{userAgent: "Mozilla/5.0 (Linux; Android 12; Pixel 6) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/104.0 Mobile", class: "mobile"},
+		{userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:104.0) Gecko/20100101 Firefox/104.0", class: "browser"},
+		{userAgent: "MyApp/1.0", class: "other"},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.class, userAgentClass(test.userAgent), test.userAgent)
+	}
+}
+
+func TestNewRateLimiterSourceCriteria(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		parts         []SourcePart
+		expectedError string
+	}{
+		{
+			desc:  "valid parts",
+			parts: []SourcePart{{RequestHeaderName: "X-Api-Key"}, {PathTemplates: []string{"/", "/users/{id}", "/files/*"}}},
+		},
+		{
+			desc:          "empty part",
+			parts:         []SourcePart{{RequestHeaderName: "X-Api-Key"}, {}},
+			expectedError: "source part 1: exactly one of IPStrategy, RequestHeaderName, RequestHost, PathTemplates, QueryParameter or UserAgentClass must be set",
+		},
+		{
+			desc:          "part with two fields",
+			parts:         []SourcePart{{RequestHeaderName: "X-Api-Key", RequestHost: true}},
+			expectedError: "source part 0: exactly one of IPStrategy, RequestHeaderName, RequestHost, PathTemplates, QueryParameter or UserAgentClass must be set",
+		},
+		{
+			desc:          "relative path template",
+			parts:         []SourcePart{{PathTemplates: []string{"users/{id}"}}},
+			expectedError: `source part 0: path template "users/{id}" does not start with /`,
+		},
+		{
+			desc:          "wildcard in the middle",
+			parts:         []SourcePart{{PathTemplates: []string{"/files/*/meta"}}},
+			expectedError: `source part 0: path template "/files/*/meta": * must be the last segment`,
+		},
+		{
+			desc:          "unclosed parameter",
+			parts:         []SourcePart{{PathTemplates: []string{"/users/{id"}}},
+			expectedError: `source part 0: path template "/users/{id": invalid segment "{id"`,
+		},
+	}
+
+	for _, test := range testCases {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			_, err := New(context.Background(), next, dynamic.RateLimit{Average: 10}, "rate-limiter", WithSourceCriteria(test.parts...))
+			if test.expectedError != "" {
+				assert.EqualError(t, err, test.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestRateLimitCompositeSource checks that an API key gets a bucket per route,
+// and that the requests without an API key share theirs.
+func TestRateLimitCompositeSource(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// One token every 100ms and a maxDelay of 50ms: none comes back during the test.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithSourceCriteria(
+			SourcePart{RequestHeaderName: "X-Api-Key"},
+			SourcePart{PathTemplates: []string{"/users/{id}", "/orders/{id}"}},
+		))
+	require.NoError(t, err)
+
+	serve := func(apiKey, path string) int {
+		req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost"+path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("a", "/users/1"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("a", "/users/2"), "same key and route")
+	assert.Equal(t, http.StatusOK, serve("a", "/orders/1"), "another route")
+	assert.Equal(t, http.StatusOK, serve("b", "/users/1"), "another key")
+	assert.Equal(t, http.StatusOK, serve("", "/users/1"))
+	assert.Equal(t, http.StatusTooManyRequests, serve("", "/users/3"), "no key")
+}
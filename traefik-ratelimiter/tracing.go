@@ -0,0 +1,84 @@
+package ratelimiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// The tags set on the span of a request, if it has one, so that a slow request in a trace
+// shows whether the rate limiter delayed it.
+const (
+	// tagKey is the key of the buckets of the request: the source, prefixed by its route if there are routes.
+	tagKey = "ratelimiter.key"
+	// tagDecision is the outcome of the request, as counted by Metrics.
+	tagDecision = "ratelimiter.decision"
+	// tagDelay is how long the request waited for its tokens, in seconds.
+	tagDelay = "ratelimiter.delay_seconds"
+	// tagRemaining is the number of tokens left once the request took its own,
+	// in the bucket that has the fewest.
+	tagRemaining = "ratelimiter.remaining"
+	// tagTier is the limit that decided: 0 for dynamic.RateLimit or the Route, then 1 for the first tier, and so on.
+	tagTier = "ratelimiter.tier"
+)
+
+// HashSpanKeys tags the spans with a hash of the key of a request, rather than the key itself,
+// which may be a client IP address or an API token.
+func HashSpanKeys() Option {
+	return func(rl *rateLimiter) {
+		rl.hashSpanKeys = true
+	}
+}
+
+// observe counts the outcome of r in the metrics, and tags its span with it.
+func (rl *rateLimiter) observe(r *http.Request, outcome string, delay time.Duration) {
+	rl.metrics.observe(rl.name, outcome, delay)
+
+	span := opentracing.SpanFromContext(r.Context())
+	if span == nil {
+		return
+	}
+	span.SetTag(tagDecision, outcome)
+	span.SetTag(tagDelay, delay.Seconds())
+}
+
+// tagReservations tags the span of r, if any, with the key of its buckets and their reservations.
+func (rl *rateLimiter) tagReservations(r *http.Request, key string, reservations []Reservation) {
+	span := opentracing.SpanFromContext(r.Context())
+	if span == nil {
+		return
+	}
+
+	if rl.hashSpanKeys {
+		sum := sha256.Sum256([]byte(key))
+		key = hex.EncodeToString(sum[:8])
+	}
+	span.SetTag(tagKey, key)
+
+	if len(reservations) == 0 {
+		return
+	}
+	tier := decisive(reservations)
+	span.SetTag(tagTier, tier)
+	span.SetTag(tagRemaining, int64(math.Max(0, math.Floor(combine(reservations).Tokens))))
+}
+
+// decisive returns the index of the reservation that decided the outcome of a request:
+// the first that is not OK, or else the one with the longest delay, or else the one with the fewest tokens left.
+func decisive(reservations []Reservation) int {
+	tier := 0
+	for i, r := range reservations {
+		if !r.OK {
+			return i
+		}
+		best := reservations[tier]
+		if r.Delay > best.Delay || r.Delay == best.Delay && r.Tokens < best.Tokens {
+			tier = i
+		}
+	}
+	return tier
+}
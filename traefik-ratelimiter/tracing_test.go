@@ -0,0 +1,125 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/traefik/traefik/v2/pkg/config/dynamic"
+	"github.com/traefik/traefik/v2/pkg/testhelpers"
+)
+
+func TestDecisive(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		reservations []Reservation
+		expected     int
+	}{
+		{
+			desc:         "one limit",
+			reservations: []Reservation{{OK: true, Tokens: 3}},
+			expected:     0,
+		},
+		{
+			desc:         "fewest tokens",
+			reservations: []Reservation{{OK: true, Tokens: 3}, {OK: true, Tokens: 1}, {OK: true, Tokens: 2}},
+			expected:     1,
+		},
+		{
+			desc:         "longest delay",
+			reservations: []Reservation{{OK: true, Tokens: -1, Delay: time.Second}, {OK: true, Tokens: -1, Delay: time.Minute}},
+			expected:     1,
+		},
+		{
+			desc:         "first rejection",
+			reservations: []Reservation{{OK: true, Delay: time.Minute}, {Delay: time.Second}, {Delay: time.Hour}},
+			expected:     1,
+		},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.expected, decisive(test.reservations), test.desc)
+	}
+}
+
+// serveTraced serves a request of 127.0.0.1 with h, within a span of tracer, and returns the tags of the span.
+func serveTraced(t *testing.T, h http.Handler, tracer *mocktracer.MockTracer) map[string]interface{} {
+	t.Helper()
+
+	tracer.Reset()
+	span := tracer.StartSpan("rate-limiter")
+	req := testhelpers.MustNewRequest(http.MethodGet, "http://localhost", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	span.Finish()
+
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 1)
+	return spans[0].Tags()
+}
+
+func TestRateLimitTracing(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tracer := mocktracer.New()
+
+	// One token every 100ms with a maxDelay of 50ms, and 2 tokens per minute.
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithTiers(Tier{Average: 2, Period: time.Minute, Burst: 2}))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		tagKey:       "127.0.0.1",
+		tagDecision:  outcomeAllowed,
+		tagDelay:     0.0,
+		tagRemaining: int64(0),
+		tagTier:      0,
+	}, serveTraced(t, h, tracer))
+
+	tags := serveTraced(t, h, tracer)
+	assert.Equal(t, outcomeRejected, tags[tagDecision])
+	assert.Equal(t, 0, tags[tagTier])
+
+	// The first limit has a token again, but not the tier.
+	time.Sleep(100 * time.Millisecond)
+	serveTraced(t, h, tracer)
+	time.Sleep(100 * time.Millisecond)
+	tags = serveTraced(t, h, tracer)
+	assert.Equal(t, outcomeRejected, tags[tagDecision])
+	assert.Equal(t, 1, tags[tagTier])
+}
+
+func TestRateLimitTracingDelay(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tracer := mocktracer.New()
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithMaxDelay(time.Second), HashSpanKeys())
+	require.NoError(t, err)
+
+	serveTraced(t, h, tracer)
+	tags := serveTraced(t, h, tracer)
+	assert.Equal(t, "12ca17b49af22894", tags[tagKey])
+	assert.Equal(t, outcomeDelayed, tags[tagDecision])
+	assert.InDelta(t, 0.1, tags[tagDelay], 0.01)
+}
+
+func TestRateLimitTracingBypass(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tracer := mocktracer.New()
+
+	h, err := New(context.Background(), next, dynamic.RateLimit{Average: 10, Burst: 1}, "rate-limiter",
+		WithExemptions(Exemptions{SourceRange: []string{"127.0.0.1/32"}}))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		tagDecision: outcomeBypassed,
+		tagDelay:    0.0,
+	}, serveTraced(t, h, tracer))
+}